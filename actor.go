@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"go.sia.tech/core/types"
+)
+
+// numActors is the number of simulated wallets that transact with each other.
+const numActors = 4
+
+// An actor is a simulated wallet. It owns every element sent to its address.
+type actor struct {
+	pk     types.PrivateKey
+	uc     types.UnlockConditions
+	addr   types.Address
+	policy types.SpendPolicy
+}
+
+func newActor(pk types.PrivateKey) actor {
+	uc := types.StandardUnlockConditions(pk.PublicKey())
+	return actor{
+		pk:     pk,
+		uc:     uc,
+		addr:   uc.UnlockHash(),
+		policy: types.SpendPolicy{Type: types.PolicyTypeUnlockConditions(uc)},
+	}
+}
+
+// deriveActors returns the fuzzer's actors. The first uses pk, so it owns the
+// genesis outputs; the keys of the others are derived from pk.
+func deriveActors(pk types.PrivateKey) []actor {
+	actors := []actor{newActor(pk)}
+	for i := 1; i < numActors; i++ {
+		buf := make([]byte, 0, 32+len("actor")+8)
+		buf = append(buf, pk[:32]...)
+		buf = append(buf, "actor"...)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(i))
+		seed := types.HashBytes(buf)
+		actors = append(actors, newActor(types.NewPrivateKeyFromSeed(seed[:])))
+	}
+	return actors
+}
+
+// A keyring maps the public key of every actor to its private key.
+type keyring map[types.PublicKey]types.PrivateKey
+
+func newKeyring(actors []actor) keyring {
+	kr := make(keyring)
+	for _, a := range actors {
+		kr[a.pk.PublicKey()] = a.pk
+	}
+	return kr
+}
+
+// unlockKey returns the key that signs for uc, which must be a standard set
+// of unlock conditions belonging to an actor.
+func (kr keyring) unlockKey(uc types.UnlockConditions) types.PrivateKey {
+	var pk types.PublicKey
+	copy(pk[:], uc.PublicKeys[0].Key)
+	return kr[pk]
+}
+
+// signPolicy returns the signatures that satisfy p, in the order its
+// public keys are checked. Opaque branches need no signatures.
+func (kr keyring) signPolicy(p types.SpendPolicy, sigHash types.Hash256) (sigs []types.Signature) {
+	switch p := p.Type.(type) {
+	case types.PolicyTypeUnlockConditions:
+		sigs = append(sigs, kr.unlockKey(types.UnlockConditions(p)).SignHash(sigHash))
+	case types.PolicyTypePublicKey:
+		sigs = append(sigs, kr[types.PublicKey(p)].SignHash(sigHash))
+	case types.PolicyTypeThreshold:
+		for _, sp := range p.Of {
+			sigs = append(sigs, kr.signPolicy(sp, sigHash)...)
+		}
+	}
+	return
+}
+
+// owner returns the actor that owns addr, if any.
+func (f *fuzzer) owner(addr types.Address) (actor, bool) {
+	for _, a := range f.actors {
+		if a.addr == addr {
+			return a, true
+		}
+	}
+	return actor{}, false
+}
+
+// tracks reports whether the fuzzer tracks elements sent to addr: those of
+// its actors and locks.
+func (f *fuzzer) tracks(addr types.Address) bool {
+	_, ok := f.owner(addr)
+	_, locked := f.locks[addr]
+	return ok || locked
+}
+
+func (f *fuzzer) randomActor() actor {
+	return f.actors[f.rng.Intn(len(f.actors))]
+}
+
+// funders picks one or two actors whose elements fund a transaction first.
+func (f *fuzzer) funders() map[types.Address]bool {
+	funders := make(map[types.Address]bool)
+	for i, n := 0, 1+f.rng.Intn(2); i < n; i++ {
+		funders[f.randomActor().addr] = true
+	}
+	return funders
+}
+
+// fundingOrder returns elements ordered so that those owned by funders come
+// first. A transaction spends from the front until it's funded, so it only
+// spends from other actors if the funders can't cover it.
+func fundingOrder[T any](elems []T, funders map[types.Address]bool, addr func(T) types.Address) []T {
+	ordered := make([]T, 0, len(elems))
+	for _, e := range elems {
+		if funders[addr(e)] {
+			ordered = append(ordered, e)
+		}
+	}
+	for _, e := range elems {
+		if !funders[addr(e)] {
+			ordered = append(ordered, e)
+		}
+	}
+	return ordered
+}
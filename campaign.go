@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A campaignFailure is a failing run saved to the corpus directory, either in
+// its bucket or, if it could not be bucketed, as its own repro file.
+type campaignFailure struct {
+	Seed      int64
+	Path      string
+	Invariant string
+	Height    uint64
+}
+
+// A campaignSummary describes the results of a campaign. It is written to
+// summary.json in the corpus directory.
+type campaignSummary struct {
+	Start    time.Time
+	Duration time.Duration
+	Runs     uint64
+	Blocks   uint64
+	Failures []campaignFailure
+}
+
+// campaignCommand fuzzes fresh seeds, starting from p.Seed, until duration
+// has elapsed or the requested number of runs have completed, whichever comes
+// first. A zero duration or run count is unlimited. Failing runs are saved to
+// dir.
+func campaignCommand(p fuzzParams, dbc dbConfig, workers int, duration time.Duration, runs uint64, dir string) error {
+	if dbc.Path != "" {
+		return errors.New("campaign runs cannot share a database path")
+	} else if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	summary := campaignSummary{Start: time.Now()}
+	var mu sync.Mutex // protects summary
+	var next atomic.Uint64
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Go(func() {
+			for ctx.Err() == nil {
+				n := next.Add(1) - 1
+				if runs > 0 && n >= runs {
+					return
+				}
+				rp := p
+				rp.Seed = p.Seed + int64(n)
+				reproPath := filepath.Join(dir, fmt.Sprintf("repro-%d.json", rp.Seed))
+				s, err := runFuzzer(ctx, rp, dbc, reproPath, log.New(io.Discard, "", 0))
+
+				mu.Lock()
+				summary.Blocks += uint64(len(s.Blocks))
+				if err == nil && ctx.Err() != nil {
+					// cut short by the deadline; doesn't count as a run, and
+					// nothing was written
+					mu.Unlock()
+					return
+				}
+				summary.Runs++
+				if err != nil {
+					log.Printf("[worker %d] seed %d failed: %v", i, rp.Seed, err)
+					cf := campaignFailure{Seed: rp.Seed, Path: reproPath}
+					if s.Failure != nil {
+						cf.Invariant, cf.Height = s.Failure.Invariant, s.Failure.Height
+						// file the repro with the others like it
+						if bucket, err := addToBucket(dir, s); err != nil {
+							log.Printf("[worker %d] failed to bucket seed %d: %v", i, rp.Seed, err)
+						} else {
+							cf.Path = bucket
+							os.Remove(reproPath)
+						}
+					}
+					summary.Failures = append(summary.Failures, cf)
+				} else {
+					os.Remove(reproPath)
+				}
+				if summary.Runs%100 == 0 {
+					log.Printf("%d runs, %d blocks, %d failures", summary.Runs, summary.Blocks, len(summary.Failures))
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	summary.Duration = time.Since(summary.Start).Round(time.Second)
+	log.Printf("Campaign finished after %v: %d runs, %d blocks mined, %d failures", summary.Duration, summary.Runs, summary.Blocks, len(summary.Failures))
+	for _, cf := range summary.Failures {
+		log.Printf("  seed %d: %s invariant at height %d (%s)", cf.Seed, cf.Invariant, cf.Height, cf.Path)
+	}
+	if err := writeJSON(filepath.Join(dir, "summary.json"), summary); err != nil {
+		return err
+	} else if len(summary.Failures) > 0 {
+		return fmt.Errorf("found %d failures, see %s", len(summary.Failures), dir)
+	}
+	return nil
+}
@@ -2,20 +2,29 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"maps"
 	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"go.sia.tech/core/consensus"
 	"go.sia.tech/core/types"
 	"go.sia.tech/coreutils"
 	"go.sia.tech/coreutils/chain"
-	"go.sia.tech/coreutils/testutil"
 	"go.uber.org/zap"
 )
 
 var (
 	// blockTimestamp is the timestamp for all blocks
 	blockTimestamp = time.Date(2025, time.January, 0, 0, 0, 0, 0, time.UTC)
+
+	// errDifferential is returned when the primary and shadow stores of a
+	// testChain disagree.
+	errDifferential = errors.New("differential")
 )
 
 func mineBlock(state consensus.State, txns []types.Transaction, v2Txns []types.V2Transaction, minerAddr types.Address) types.Block {
@@ -48,9 +57,63 @@ func mineBlock(state consensus.State, txns []types.Transaction, v2Txns []types.V
 	return b
 }
 
+// A dbConfig selects the database backing a testChain.
+type dbConfig struct {
+	Bolt bool
+	// Path is the location of the bolt database. If empty, a temporary file
+	// is used.
+	Path string
+	// Differential keeps a second store, backed by the other kind of
+	// database, in lockstep with the first and compares the two after every
+	// block.
+	Differential bool
+}
+
+// parseDBConfig parses a database flag of the form memory|bolt[:path].
+func parseDBConfig(s string) (dbConfig, error) {
+	switch kind, path, _ := strings.Cut(s, ":"); kind {
+	case "memory":
+		if path != "" {
+			return dbConfig{}, fmt.Errorf("memory database does not take a path")
+		}
+		return dbConfig{}, nil
+	case "bolt":
+		return dbConfig{Bolt: true, Path: path}, nil
+	default:
+		return dbConfig{}, fmt.Errorf("unknown database %q, expected memory or bolt[:path]", s)
+	}
+}
+
+func openDB(bolt bool, path string) (chain.DB, func() error, error) {
+	if !bolt {
+		return chain.NewMemDB(), func() error { return nil }, nil
+	} else if path != "" {
+		db, err := coreutils.OpenBoltChainDB(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, db.Close, nil
+	}
+
+	dir, err := os.MkdirTemp("", "fuzzer-")
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := coreutils.OpenBoltChainDB(filepath.Join(dir, "consensus.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	return db, func() error {
+		defer os.RemoveAll(dir)
+		return db.Close()
+	}, nil
+}
+
 type testChain struct {
-	db    *coreutils.BoltChainDB
-	store *chain.DBStore
+	store  *chain.DBStore
+	shadow *chain.DBStore // nil unless running in differential mode
+	closes []func() error
 
 	network     *consensus.Network
 	blocks      []types.Block
@@ -58,33 +121,47 @@ type testChain struct {
 	states      []consensus.State
 }
 
-func newTestChain(modifyGenesis func(*consensus.Network, types.Block)) (*testChain, error) {
-	network, genesisBlock := testutil.Network()
-	if modifyGenesis != nil {
-		modifyGenesis(network, genesisBlock)
-	}
-	genesisBlock.Timestamp = blockTimestamp
+func newTestChain(dbc dbConfig, network *consensus.Network, genesisBlock types.Block) (_ *testChain, err error) {
+	n := &testChain{network: network}
+	defer func() {
+		if err != nil {
+			n.Close()
+		}
+	}()
 
-	db, err := coreutils.OpenBoltChainDB("consensus.db")
+	log, err := zap.NewDevelopment()
 	if err != nil {
 		return nil, err
 	}
 
-	log, err := zap.NewDevelopment()
+	db, closeDB, err := openDB(dbc.Bolt, dbc.Path)
 	if err != nil {
 		return nil, err
 	}
-
-	store, err := chain.NewDBStore(db, network, genesisBlock, chain.NewZapMigrationLogger(log))
+	n.closes = append(n.closes, closeDB)
+	n.store, err = chain.NewDBStore(db, network, genesisBlock, chain.NewZapMigrationLogger(log))
 	if err != nil {
 		return nil, err
 	}
-	sp := store.Scratchpad()
-	genesisState := store.Scratchpad().TipState()
 
-	var blocks []types.Block
-	var supplements []consensus.V1BlockSupplement
-	states := []consensus.State{network.GenesisState()}
+	if dbc.Differential {
+		db, closeDB, err := openDB(!dbc.Bolt, "")
+		if err != nil {
+			return nil, err
+		}
+		n.closes = append(n.closes, closeDB)
+		n.shadow, err = chain.NewDBStore(db, network, genesisBlock, chain.NewZapMigrationLogger(log))
+		if err != nil {
+			return nil, err
+		} else if err := n.checkShadow(); err != nil {
+			return nil, fmt.Errorf("differential mode requires a fresh database: %w", err)
+		}
+	}
+
+	sp := n.store.Scratchpad()
+	genesisState := sp.TipState()
+
+	n.states = []consensus.State{network.GenesisState()}
 	for i := uint64(0); i <= genesisState.Index.Height; i++ {
 		index, ok := sp.BestIndex(i)
 		if !ok {
@@ -101,24 +178,131 @@ func newTestChain(modifyGenesis func(*consensus.Network, types.Block)) (*testCha
 			return nil, errors.New("failed to get State")
 		}
 
-		blocks = append(blocks, b)
-		supplements = append(supplements, *bs)
-		states = append(states, cs)
+		n.blocks = append(n.blocks, b)
+		n.supplements = append(n.supplements, *bs)
+		n.states = append(n.states, cs)
 	}
+	return n, nil
+}
 
-	return &testChain{
-		db:    db,
-		store: store,
+func (n *testChain) Close() error {
+	var errs []error
+	for _, fn := range n.closes {
+		errs = append(errs, fn())
+	}
+	return errors.Join(errs...)
+}
 
-		network:     network,
-		blocks:      blocks,
-		supplements: supplements,
-		states:      states,
-	}, nil
+// checkShadow compares the tip of the primary store against the shadow
+// store.
+func (n *testChain) checkShadow() error {
+	if n.shadow == nil {
+		return nil
+	}
+	sp, shadow := n.store.Scratchpad(), n.shadow.Scratchpad()
+
+	cs1, cs2 := sp.TipState(), shadow.TipState()
+	if cs1.Index != cs2.Index {
+		return fmt.Errorf("%w: tip %v vs %v", errDifferential, cs1.Index, cs2.Index)
+	} else if stateHash(cs1) != stateHash(cs2) {
+		return fmt.Errorf("%w: state hash at %v: %v vs %v", errDifferential, cs1.Index, stateHash(cs1), stateHash(cs2))
+	}
+
+	index1, ok1 := sp.BestIndex(cs1.Index.Height)
+	index2, ok2 := shadow.BestIndex(cs1.Index.Height)
+	if ok1 != ok2 || index1 != index2 {
+		return fmt.Errorf("%w: best index at height %d: %v (%v) vs %v (%v)", errDifferential, cs1.Index.Height, index1, ok1, index2, ok2)
+	}
+
+	b1, bs1, ok1 := sp.Block(cs1.Index.ID)
+	b2, bs2, ok2 := shadow.Block(cs1.Index.ID)
+	if ok1 != ok2 || b1.ID() != b2.ID() {
+		return fmt.Errorf("%w: block %v: %v (%v) vs %v (%v)", errDifferential, cs1.Index, b1.ID(), ok1, b2.ID(), ok2)
+	} else if (bs1 == nil) != (bs2 == nil) {
+		return fmt.Errorf("%w: block %v: supplement presence %v vs %v", errDifferential, cs1.Index, bs1 != nil, bs2 != nil)
+	} else if bs1 != nil {
+		if err := diffSupplements(*bs1, *bs2); err != nil {
+			return fmt.Errorf("%w: block %v: mismatched stored supplement: %v", errDifferential, cs1.Index, err)
+		}
+	}
+
+	if err := diffSupplements(sp.SupplementTipBlock(types.Block{}), shadow.SupplementTipBlock(types.Block{})); err != nil {
+		return fmt.Errorf("%w: mismatched tip supplement at %v: %v", errDifferential, cs1.Index, err)
+	}
+	return nil
 }
 
-func (n *testChain) Close() error {
-	return n.db.Close()
+// checkStore compares the primary store's best chain against the states the
+// testChain has applied, and every block and supplement on it against the
+// testChain's, so that entries a revert left stale are caught.
+func (n *testChain) checkStore() error {
+	sp := n.store.Scratchpad()
+	tip := n.tipState()
+	if cs, ok := sp.State(tip.Index.ID); !ok {
+		return fmt.Errorf("missing state for tip %v", tip.Index)
+	} else if stateHash(cs) != stateHash(tip) {
+		return fmt.Errorf("stored state for tip %v has hash %v, expected %v", tip.Index, stateHash(cs), stateHash(tip))
+	}
+
+	for _, cs := range n.states[1:] {
+		best, ok := sp.BestIndex(cs.Index.Height)
+		if !ok {
+			return fmt.Errorf("missing best index at height %d", cs.Index.Height)
+		} else if best != cs.Index {
+			return fmt.Errorf("best index at height %d is %v, expected %v", cs.Index.Height, best, cs.Index)
+		}
+	}
+	if best, ok := sp.BestIndex(tip.Index.Height + 1); ok {
+		return fmt.Errorf("stale best index %v above tip %v", best, tip.Index)
+	}
+
+	for i, expected := range n.blocks {
+		index := n.states[i+1].Index
+		b, bs, ok := sp.Block(index.ID)
+		if !ok {
+			return fmt.Errorf("missing block %v", index)
+		} else if b.ID() != expected.ID() {
+			return fmt.Errorf("stored block at %v has ID %v", index, b.ID())
+		} else if bs == nil {
+			// the genesis block may be stored without one
+			if i > 0 {
+				return fmt.Errorf("missing supplement for block %v", index)
+			}
+		} else if err := diffSupplements(n.supplements[i], *bs); err != nil {
+			return fmt.Errorf("mismatched stored supplement for block %v: %w", index, err)
+		}
+	}
+	return nil
+}
+
+// expiringIDs returns the IDs of the v1 contracts the store expects to expire
+// at each height from the child of the tip through maxHeight, in the order
+// they're listed in supplements.
+func (n *testChain) expiringIDs(maxHeight uint64) map[uint64][]types.FileContractID {
+	sp := n.store.Scratchpad()
+	ids := make(map[uint64][]types.FileContractID)
+	for h := n.tip().Height + 1; h <= maxHeight; h++ {
+		ids[h] = sp.ExpiringFileContractIDs(h)
+	}
+	return ids
+}
+
+// compareExpirations checks that the store lists the same expiring contracts
+// in the same order after a block was applied and reverted. The order decides
+// the leaves of missed proof outputs, so it must not depend on reorgs.
+func compareExpirations(before, after map[uint64][]types.FileContractID) error {
+	for _, h := range slices.Sorted(maps.Keys(before)) {
+		want, got := before[h], after[h]
+		if len(got) != len(want) {
+			return fmt.Errorf("%d contracts expire at height %d, expected %d", len(got), h, len(want))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				return fmt.Errorf("expiring contract %d of %d at height %d is %v, expected %v", i, len(want), h, got[i], want[i])
+			}
+		}
+	}
+	return nil
 }
 
 func (n *testChain) tipState() consensus.State {
@@ -133,6 +317,11 @@ func (n *testChain) applyBlock(b types.Block) (consensus.ApplyUpdate, error) {
 	cs := n.tipState()
 	sp := n.store.Scratchpad()
 	bs := sp.SupplementTipBlock(b)
+	if n.shadow != nil {
+		if err := diffSupplements(bs, n.shadow.Scratchpad().SupplementTipBlock(b)); err != nil {
+			return consensus.ApplyUpdate{}, fmt.Errorf("%w: mismatched supplement for block %v: %v", errDifferential, b.ID(), err)
+		}
+	}
 	if (cs.Index.Height + 1) >= cs.Network.HardforkV2.RequireHeight {
 		bs = consensus.V1BlockSupplement{}
 	}
@@ -149,15 +338,21 @@ func (n *testChain) applyBlock(b types.Block) (consensus.ApplyUpdate, error) {
 	sp.AddState(cs)
 	sp.AddBlock(b, &bs)
 	sp.ApplyBlock(cs, au)
+	if n.shadow != nil {
+		ssp := n.shadow.Scratchpad()
+		ssp.AddState(cs)
+		ssp.AddBlock(b, &bs)
+		ssp.ApplyBlock(cs, au)
+	}
 
 	n.blocks = append(n.blocks, b)
 	n.supplements = append(n.supplements, bs)
 	n.states = append(n.states, cs)
 
-	return au, nil
+	return au, n.checkShadow()
 }
 
-func (n *testChain) revertBlock() consensus.RevertUpdate {
+func (n *testChain) revertBlock() (consensus.RevertUpdate, error) {
 	b := n.blocks[len(n.blocks)-1]
 	bs := n.supplements[len(n.supplements)-1]
 	prevState := n.states[len(n.states)-2]
@@ -165,12 +360,15 @@ func (n *testChain) revertBlock() consensus.RevertUpdate {
 	ru := consensus.RevertBlock(prevState, b, bs)
 
 	n.store.Scratchpad().RevertBlock(prevState, ru)
+	if n.shadow != nil {
+		n.shadow.Scratchpad().RevertBlock(prevState, ru)
+	}
 
 	n.blocks = n.blocks[:len(n.blocks)-1]
 	n.supplements = n.supplements[:len(n.supplements)-1]
 	n.states = n.states[:len(n.states)-1]
 
-	return ru
+	return ru, n.checkShadow()
 }
 
 func (n *testChain) mineTransactions(txns []types.Transaction, v2Txns []types.V2Transaction) {
@@ -178,9 +376,9 @@ func (n *testChain) mineTransactions(txns []types.Transaction, v2Txns []types.V2
 	n.applyBlock(b)
 }
 
-// signTransaction signs a transaction using the specified private keys,
-// including contract revisions.
-func signTransaction(cs consensus.State, pk types.PrivateKey, txn *types.Transaction) {
+// signTransaction signs each of a transaction's inputs and contract
+// revisions with the key of the actor whose unlock conditions it carries.
+func signTransaction(cs consensus.State, keys keyring, txn *types.Transaction) {
 	appendSig := func(key types.PrivateKey, pubkeyIndex uint64, parentID types.Hash256) {
 		sig := key.SignHash(cs.WholeSigHash(*txn, parentID, pubkeyIndex, 0, nil))
 		txn.Signatures = append(txn.Signatures, types.TransactionSignature{
@@ -190,43 +388,47 @@ func signTransaction(cs consensus.State, pk types.PrivateKey, txn *types.Transac
 			Signature:      sig[:],
 		})
 	}
-	for i := range txn.SiacoinInputs {
-		appendSig(pk, 0, types.Hash256(txn.SiacoinInputs[i].ParentID))
+	for _, sci := range txn.SiacoinInputs {
+		appendSig(keys.unlockKey(sci.UnlockConditions), 0, types.Hash256(sci.ParentID))
 	}
-	for i := range txn.SiafundInputs {
-		appendSig(pk, 0, types.Hash256(txn.SiafundInputs[i].ParentID))
+	for _, sfi := range txn.SiafundInputs {
+		appendSig(keys.unlockKey(sfi.UnlockConditions), 0, types.Hash256(sfi.ParentID))
 	}
-	for i := range txn.FileContractRevisions {
-		appendSig(pk, 0, types.Hash256(txn.FileContractRevisions[i].ParentID))
+	for _, fcr := range txn.FileContractRevisions {
+		appendSig(keys.unlockKey(fcr.UnlockConditions), 0, types.Hash256(fcr.ParentID))
 	}
 }
 
-// signV2Transaction signs a transaction using the specified private key,
-// including contracts and revisions.
-func signV2Transaction(cs consensus.State, pk types.PrivateKey, txn *types.V2Transaction) {
+// signV2Transaction signs a transaction's inputs, attestations, contracts,
+// revisions and renewals, each with the key of the actor it belongs to.
+func signV2Transaction(cs consensus.State, keys keyring, txn *types.V2Transaction) {
+	signContract := func(fc *types.V2FileContract) {
+		fc.RenterSignature = keys[fc.RenterPublicKey].SignHash(cs.ContractSigHash(*fc))
+		fc.HostSignature = keys[fc.HostPublicKey].SignHash(cs.ContractSigHash(*fc))
+	}
 	for i := range txn.Attestations {
-		txn.Attestations[i].Signature = pk.SignHash(cs.AttestationSigHash(txn.Attestations[i]))
+		txn.Attestations[i].Signature = keys[txn.Attestations[i].PublicKey].SignHash(cs.AttestationSigHash(txn.Attestations[i]))
 	}
 	for i := range txn.SiacoinInputs {
-		txn.SiacoinInputs[i].SatisfiedPolicy.Signatures = []types.Signature{pk.SignHash(cs.InputSigHash(*txn))}
+		sp := &txn.SiacoinInputs[i].SatisfiedPolicy
+		sp.Signatures = keys.signPolicy(sp.Policy, cs.InputSigHash(*txn))
 	}
 	for i := range txn.SiafundInputs {
-		txn.SiafundInputs[i].SatisfiedPolicy.Signatures = []types.Signature{pk.SignHash(cs.InputSigHash(*txn))}
+		sp := &txn.SiafundInputs[i].SatisfiedPolicy
+		sp.Signatures = keys.signPolicy(sp.Policy, cs.InputSigHash(*txn))
 	}
 	for i := range txn.FileContracts {
-		txn.FileContracts[i].RenterSignature = pk.SignHash(cs.ContractSigHash(txn.FileContracts[i]))
-		txn.FileContracts[i].HostSignature = pk.SignHash(cs.ContractSigHash(txn.FileContracts[i]))
+		signContract(&txn.FileContracts[i])
 	}
 	for i := range txn.FileContractRevisions {
-		txn.FileContractRevisions[i].Revision.RenterSignature = pk.SignHash(cs.ContractSigHash(txn.FileContractRevisions[i].Revision))
-		txn.FileContractRevisions[i].Revision.HostSignature = pk.SignHash(cs.ContractSigHash(txn.FileContractRevisions[i].Revision))
+		signContract(&txn.FileContractRevisions[i].Revision)
 	}
 	for i := range txn.FileContractResolutions {
 		if r, ok := txn.FileContractResolutions[i].Resolution.(*types.V2FileContractRenewal); ok {
-			r.RenterSignature = pk.SignHash(cs.RenewalSigHash(*r))
-			r.HostSignature = pk.SignHash(cs.RenewalSigHash(*r))
-			r.NewContract.RenterSignature = pk.SignHash(cs.ContractSigHash(r.NewContract))
-			r.NewContract.HostSignature = pk.SignHash(cs.ContractSigHash(r.NewContract))
+			fc := txn.FileContractResolutions[i].Parent.V2FileContract
+			r.RenterSignature = keys[fc.RenterPublicKey].SignHash(cs.RenewalSigHash(*r))
+			r.HostSignature = keys[fc.HostPublicKey].SignHash(cs.RenewalSigHash(*r))
+			signContract(&r.NewContract)
 		}
 	}
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+
+	"go.sia.tech/core/types"
+)
+
+// exportBinaryThreshold is the size, in bytes of JSON, above which an
+// exported chain is embedded in compressed binary form instead.
+const exportBinaryThreshold = 32 << 10
+
+var exportTemplate = template.Must(template.New("test").Parse(`package {{.Package}}
+
+import (
+	"bytes"
+{{- if .Binary}}
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"math"
+	"strings"
+{{- end}}
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+
+	"go.sia.tech/core/consensus"
+	"go.sia.tech/core/types"
+{{- if .Qualifier}}
+	"go.sia.tech/coreutils/chain"
+{{- end}}
+)
+
+// Test{{.Name}} replays a chain generated by go.sia.tech/fuzzer
+// (seed {{.Seed}}, core {{.Versions.Core}}, coreutils {{.Versions.Coreutils}}).
+{{- if .Failure}}
+// It failed the {{.Failure.Invariant}} invariant at height {{.Failure.Height}}:
+//
+//	{{.FailureMessage}}
+{{- end}}
+func Test{{.Name}}(t *testing.T) {
+	var network consensus.Network
+	if err := json.Unmarshal([]byte(network{{.Name}}), &network); err != nil {
+		t.Fatal(err)
+	}
+	var genesisBlock types.Block
+	var blocks []types.Block
+{{- if .Binary}}
+	gz, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(chain{{.Name}})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := types.NewDecoder(io.LimitedReader{R: gz, N: math.MaxInt64})
+	(*types.V2Block)(&genesisBlock).DecodeFrom(d)
+	types.DecodeSliceCast[types.V2Block](d, &blocks)
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+{{- else}}
+	if err := json.Unmarshal([]byte(genesis{{.Name}}), &genesisBlock); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal([]byte(chain{{.Name}}), &blocks); err != nil {
+		t.Fatal(err)
+	}
+{{- end}}
+
+	store, err := {{.Qualifier}}NewDBStore({{.Qualifier}}NewMemDB(), &network, genesisBlock, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := store.Scratchpad()
+
+	states := []consensus.State{sp.TipState()}
+	var supplements []consensus.V1BlockSupplement
+	applyBlock := func(b types.Block) {
+		t.Helper()
+		cs := states[len(states)-1]
+		bs := sp.SupplementTipBlock(b)
+		if cs.Index.Height+1 >= cs.Network.HardforkV2.RequireHeight {
+			bs = consensus.V1BlockSupplement{}
+		}
+		if err := consensus.ValidateBlock(cs, b, bs); err != nil {
+			t.Fatalf("failed to apply block at height %d: %v", cs.Index.Height+1, err)
+		}
+		cs, au := consensus.ApplyBlock(cs, b, bs, b.Timestamp)
+		sp.AddState(cs)
+		sp.AddBlock(b, &bs)
+		sp.ApplyBlock(cs, au)
+		states = append(states, cs)
+		supplements = append(supplements, bs)
+	}
+	revertBlock := func(b types.Block) {
+		prevState := states[len(states)-2]
+		ru := consensus.RevertBlock(prevState, b, supplements[len(supplements)-1])
+		sp.RevertBlock(prevState, ru)
+		states = states[:len(states)-1]
+		supplements = supplements[:len(supplements)-1]
+	}
+	supplementsEqual := func(a, b consensus.V1BlockSupplement) bool {
+		for _, bs := range []*consensus.V1BlockSupplement{&a, &b} {
+			bs.ExpiringFileContracts = slices.Clone(bs.ExpiringFileContracts)
+			slices.SortFunc(bs.ExpiringFileContracts, func(x, y types.FileContractElement) int {
+				return bytes.Compare(x.ID[:], y.ID[:])
+			})
+		}
+		return reflect.DeepEqual(a, b)
+	}
+
+	// apply, revert, and reapply each block, checking that the tip
+	// supplements are unaffected
+	for _, b := range blocks {
+		height := states[len(states)-1].Index.Height + 1
+		bs1 := sp.SupplementTipBlock(types.Block{})
+		applyBlock(b)
+		bs2 := sp.SupplementTipBlock(types.Block{})
+		revertBlock(b)
+		bs3 := sp.SupplementTipBlock(types.Block{})
+		applyBlock(b)
+		bs4 := sp.SupplementTipBlock(types.Block{})
+		if !supplementsEqual(bs1, bs3) || !supplementsEqual(bs2, bs4) {
+			t.Fatalf("mismatched block supplement at height %d", height)
+		}
+	}
+
+	// revert every block, then reapply them and check that the chain ends up
+	// in the same state
+	tip := states[len(states)-1]
+	for i := len(blocks) - 1; i >= 0; i-- {
+		revertBlock(blocks[i])
+	}
+	for _, b := range blocks {
+		applyBlock(b)
+	}
+	if got := states[len(states)-1]; got != tip {
+		t.Fatalf("mismatched state after reverting all and reapplying, expected %v, got %v", tip, got)
+	}
+}
+
+const network{{.Name}} = ` + "`{{.Network}}`" + `
+{{- if not .Binary}}
+
+const genesis{{.Name}} = ` + "`{{.Genesis}}`" + `
+{{- end}}
+
+const chain{{.Name}} = ` + "`\n{{.Chain}}`" + `
+`))
+
+// exportedInvariants are the invariants an exported test checks. A repro
+// that failed any other would pass as a test, so it isn't exported.
+var exportedInvariants = map[string]bool{
+	invariantApply:      true,
+	invariantSupplement: true,
+	invariantReapply:    true,
+}
+
+// exportable reports whether an exported test would fail the same way as f.
+// Panics count if they come from core or coreutils, which the test calls in
+// the same way as the fuzzer.
+func exportable(f *failure) bool {
+	if f.Invariant == invariantPanic {
+		frame := stackTop(f.Error)
+		return strings.HasPrefix(frame, "go.sia.tech/core/") || strings.HasPrefix(frame, "go.sia.tech/coreutils/")
+	}
+	return exportedInvariants[f.Invariant]
+}
+
+type exportData struct {
+	Package   string
+	Qualifier string
+	Name      string
+
+	Seed           int64
+	Versions       dependencyVersions
+	Failure        *failure
+	FailureMessage string
+
+	Binary  bool
+	Network string
+	Genesis string
+	Chain   string
+}
+
+// encodeChainBinary returns the genesis block followed by the chain's blocks
+// in core's binary encoding, gzipped and base64-encoded in lines of 76
+// characters.
+func encodeChainBinary(genesis types.Block, blocks []types.Block) (string, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	e := types.NewEncoder(gz)
+	types.V2Block(genesis).EncodeTo(e)
+	types.EncodeSliceCast[types.V2Block](e, blocks)
+	if err := e.Flush(); err != nil {
+		return "", err
+	} else if err := gz.Close(); err != nil {
+		return "", err
+	}
+	enc := base64.StdEncoding.EncodeToString(buf.Bytes())
+	var sb strings.Builder
+	for len(enc) > 76 {
+		sb.WriteString(enc[:76] + "\n")
+		enc = enc[76:]
+	}
+	sb.WriteString(enc + "\n")
+	return sb.String(), nil
+}
+
+// encodeChainJSON returns the chain's blocks as a JSON array with one block
+// per line.
+func encodeChainJSON(blocks []types.Block) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("[\n")
+	for i, b := range blocks {
+		js, err := json.Marshal(b)
+		if err != nil {
+			return "", err
+		}
+		sb.Write(js)
+		if i < len(blocks)-1 {
+			sb.WriteByte(',')
+		}
+		sb.WriteByte('\n')
+	}
+	sb.WriteString("]\n")
+	return sb.String(), nil
+}
+
+func exportTestCommand(path, outPath, pkg string) error {
+	s, err := readState(path)
+	if err != nil {
+		return err
+	} else if s.Failure != nil && !exportable(s.Failure) {
+		return fmt.Errorf("%s failed the %q invariant, which exported tests don't check", path, s.Failure.Invariant)
+	}
+
+	network, err := json.Marshal(s.Network)
+	if err != nil {
+		return err
+	}
+	genesis, err := json.Marshal(s.Genesis)
+	if err != nil {
+		return err
+	}
+	h := types.NewHasher()
+	types.V2Block(s.Genesis).EncodeTo(h.E)
+	types.EncodeSliceCast[types.V2Block](h.E, s.Blocks)
+	id := h.Sum()
+
+	data := exportData{
+		Package:  pkg,
+		Name:     "FuzzRepro" + hex.EncodeToString(id[:4]),
+		Seed:     s.Params.Seed,
+		Versions: s.Versions,
+		Failure:  s.Failure,
+		Network:  string(network),
+		Genesis:  string(genesis),
+	}
+	// inside package chain itself, its identifiers are unqualified
+	if pkg != "chain" {
+		data.Qualifier = "chain."
+	}
+	if s.Failure != nil {
+		data.FailureMessage, _, _ = strings.Cut(s.Failure.Error, "\n")
+	}
+
+	data.Chain, err = encodeChainJSON(s.Blocks)
+	if err != nil {
+		return err
+	}
+	// raw strings can't contain backticks
+	if len(data.Chain) > exportBinaryThreshold || strings.ContainsRune(data.Chain+data.Genesis+data.Network, '`') {
+		data.Binary = true
+		data.Chain, err = encodeChainBinary(s.Genesis, s.Blocks)
+		if err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := exportTemplate.Execute(&buf, data); err != nil {
+		return err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to format generated test: %w", err)
+	}
+	if outPath == "" {
+		outPath = fmt.Sprintf("fuzz_repro_%x_test.go", id[:4])
+	}
+	if err := os.WriteFile(outPath, src, 0666); err != nil {
+		return err
+	}
+	log.Printf("Wrote Test%s to %s (%d blocks)", data.Name, outPath, len(s.Blocks))
+	return nil
+}
@@ -1,40 +1,79 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"math"
 	"math/rand"
 
 	"go.sia.tech/core/consensus"
 	"go.sia.tech/core/types"
+	"go.sia.tech/coreutils/testutil"
 )
 
+// A source supplies the randomness behind every generation decision.
+// *rand.Rand is a source; so is the input of a native Go fuzz test.
+type source interface {
+	Intn(n int) int
+	Read(p []byte) (int, error)
+}
+
 type fuzzer struct {
-	rng *rand.Rand
+	rng source
 	n   *testChain
 
-	pk     types.PrivateKey
-	uc     types.UnlockConditions
-	addr   types.Address
-	policy types.SpendPolicy
+	actors []actor
+	keys   keyring
+	locks  map[types.Address]lock
 
 	cies   []types.ChainIndexElement
 	sces   map[types.SiacoinOutputID]types.SiacoinElement
 	sfes   map[types.SiafundOutputID]types.SiafundElement
 	fces   map[types.FileContractID]types.FileContractElement
 	v2fces map[types.FileContractID]types.V2FileContractElement
+	files  map[types.Hash256][]byte // data of unresolved contracts by Merkle root
+	proved map[types.Hash256][]byte // data storage proofs have been built for
+
+	windowEnds map[uint64]bool // reserved by contracts in the block being mined
+
+	knownBugs bool // see reordersExpirations
+
+	pool    types.Currency // shadow siafund pool
+	history []checkpoint   // one per block passed to checkBlock
+	invalid []invalidTxn   // generated alongside the next block
+}
+
+// newRNG returns the rng for the given seed, along with the key of the
+// fuzzer's first actor derived from it.
+func newRNG(seed int64) (*rand.Rand, types.PrivateKey) {
+	rng := rand.New(rand.NewSource(seed))
+	keySeed := make([]byte, ed25519.SeedSize)
+	rng.Read(keySeed)
+	return rng, types.NewPrivateKeyFromSeed(keySeed)
 }
 
-func newFuzzer(rng *rand.Rand, pk types.PrivateKey, allowHeight, requireHeight uint64) (*fuzzer, error) {
-	uc := types.StandardUnlockConditions(pk.PublicKey())
-	addr := uc.UnlockHash()
-
-	n, err := newTestChain(func(network *consensus.Network, genesisBlock types.Block) {
-		network.HardforkV2.AllowHeight = allowHeight
-		network.HardforkV2.RequireHeight = requireHeight
-		network.HardforkV2.FinalCutHeight = requireHeight + 50
-		genesisBlock.Transactions[0].SiacoinOutputs[0].Address = addr
-		genesisBlock.Transactions[0].SiafundOutputs[0].Address = addr
-	})
+// fillRandom fills p from a generator seeded by a single draw from f.rng.
+// Keys, preimages and file contents never change what the fuzzer does, so
+// they shouldn't use up a fuzz input that could steer it.
+func (f *fuzzer) fillRandom(p []byte) {
+	rand.New(rand.NewSource(int64(f.rng.Intn(1 << 31)))).Read(p)
+}
+
+// fuzzNetwork returns the network and genesis block used for fuzzing, with
+// the genesis outputs sent to addr.
+func fuzzNetwork(addr types.Address, allowHeight, requireHeight uint64) (*consensus.Network, types.Block) {
+	network, genesisBlock := testutil.Network()
+	network.HardforkV2.AllowHeight = allowHeight
+	network.HardforkV2.RequireHeight = requireHeight
+	network.HardforkV2.FinalCutHeight = requireHeight + 50
+	genesisBlock.Transactions[0].SiacoinOutputs[0].Address = addr
+	genesisBlock.Transactions[0].SiafundOutputs[0].Address = addr
+	genesisBlock.Timestamp = blockTimestamp
+	return network, genesisBlock
+}
+
+func newFuzzer(rng source, pk types.PrivateKey, dbc dbConfig, network *consensus.Network, genesisBlock types.Block) (*fuzzer, error) {
+	actors := deriveActors(pk)
+	n, err := newTestChain(dbc, network, genesisBlock)
 	if err != nil {
 		return nil, err
 	}
@@ -44,15 +83,16 @@ func newFuzzer(rng *rand.Rand, pk types.PrivateKey, allowHeight, requireHeight u
 
 		rng: rng,
 
-		pk:     pk,
-		uc:     uc,
-		addr:   addr,
-		policy: types.SpendPolicy(types.SpendPolicy{Type: types.PolicyTypeUnlockConditions(uc)}),
+		actors: actors,
+		keys:   newKeyring(actors),
+		locks:  make(map[types.Address]lock),
 
 		sces:   make(map[types.SiacoinOutputID]types.SiacoinElement),
 		sfes:   make(map[types.SiafundOutputID]types.SiafundElement),
 		fces:   make(map[types.FileContractID]types.FileContractElement),
 		v2fces: make(map[types.FileContractID]types.V2FileContractElement),
+		files:  make(map[types.Hash256][]byte),
+		proved: make(map[types.Hash256][]byte),
 	}
 
 	for i := range f.n.blocks {
@@ -71,6 +111,7 @@ func newFuzzer(rng *rand.Rand, pk types.PrivateKey, allowHeight, requireHeight u
 		}
 		_, au := consensus.ApplyBlock(cs, b, bs, b.Timestamp)
 		f.processApplyUpdate(au)
+		f.pool = f.pool.Add(blockTax(cs, b))
 	}
 
 	return f, nil
@@ -80,23 +121,31 @@ func (f *fuzzer) Close() error {
 	return f.n.Close()
 }
 
-func (f *fuzzer) applyBlock(b types.Block) error {
+func (f *fuzzer) applyBlock(b types.Block) (consensus.ApplyUpdate, error) {
 	au, err := f.n.applyBlock(b)
 	if err != nil {
-		return err
+		return consensus.ApplyUpdate{}, err
 	}
 	f.processApplyUpdate(au)
-	return nil
+	return au, nil
 }
 
-func (f *fuzzer) revertBlock() {
-	ru := f.n.revertBlock()
+func (f *fuzzer) revertBlock() (consensus.RevertUpdate, error) {
+	ru, err := f.n.revertBlock()
+	if err != nil {
+		return consensus.RevertUpdate{}, err
+	}
 	f.processRevertUpdate(ru)
+	return ru, nil
 }
 
 func (f *fuzzer) mineBlock() types.Block {
+	f.windowEnds = make(map[uint64]bool)
+	f.pruneFiles()
 	var txns []types.Transaction
 	if f.n.tip().Height < (f.n.network.HardforkV2.RequireHeight - 1) {
+		// before any of the block's revisions, so that parents match the tip
+		f.generateInvalidRevisions()
 		for i := 0; i < f.rng.Intn(20); i++ {
 			txns = append(txns, f.generateTransaction())
 		}
@@ -111,6 +160,7 @@ func (f *fuzzer) mineBlock() types.Block {
 		for i := 0; i < f.rng.Intn(20); i++ {
 			v2Txns = append(v2Txns, f.generateV2Transaction(originalParents))
 		}
+		f.generateTimelockSpends()
 	}
 
 	return mineBlock(f.n.tipState(), txns, v2Txns, types.VoidAddress)
@@ -118,7 +168,7 @@ func (f *fuzzer) mineBlock() types.Block {
 
 func (f *fuzzer) processApplyUpdate(au consensus.ApplyUpdate) {
 	for _, diff := range au.SiacoinElementDiffs() {
-		if diff.SiacoinElement.SiacoinOutput.Address != f.addr {
+		if !f.tracks(diff.SiacoinElement.SiacoinOutput.Address) {
 			continue
 		} else if diff.Created && diff.Spent {
 			continue
@@ -132,7 +182,7 @@ func (f *fuzzer) processApplyUpdate(au consensus.ApplyUpdate) {
 		}
 	}
 	for _, diff := range au.SiafundElementDiffs() {
-		if diff.SiafundElement.SiafundOutput.Address != f.addr {
+		if !f.tracks(diff.SiafundElement.SiafundOutput.Address) {
 			continue
 		} else if diff.Created && diff.Spent {
 			continue
@@ -193,7 +243,7 @@ func (f *fuzzer) processApplyUpdate(au consensus.ApplyUpdate) {
 
 func (f *fuzzer) processRevertUpdate(ru consensus.RevertUpdate) {
 	for _, diff := range ru.SiacoinElementDiffs() {
-		if diff.SiacoinElement.SiacoinOutput.Address != f.addr {
+		if !f.tracks(diff.SiacoinElement.SiacoinOutput.Address) {
 			continue
 		} else if diff.Created && diff.Spent {
 			continue
@@ -207,7 +257,7 @@ func (f *fuzzer) processRevertUpdate(ru consensus.RevertUpdate) {
 		}
 	}
 	for _, diff := range ru.SiafundElementDiffs() {
-		if diff.SiafundElement.SiafundOutput.Address != f.addr {
+		if !f.tracks(diff.SiafundElement.SiafundOutput.Address) {
 			continue
 		} else if diff.Created && diff.Spent {
 			continue
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+
+	"go.sia.tech/core/types"
+)
+
+// A byteSource draws randomness from a fuzz input, so that the fuzzing
+// engine's mutations steer generation. Once the input is exhausted, every
+// draw returns zero.
+type byteSource struct {
+	data []byte
+}
+
+func (s *byteSource) next() byte {
+	if len(s.data) == 0 {
+		return 0
+	}
+	b := s.data[0]
+	s.data = s.data[1:]
+	return b
+}
+
+// Intn implements source. It consumes as few bytes as are needed to cover
+// [0, n).
+func (s *byteSource) Intn(n int) int {
+	if n <= 0 {
+		panic("invalid argument to Intn")
+	}
+	var v uint64
+	for rem := n - 1; rem > 0; rem >>= 8 {
+		v = v<<8 | uint64(s.next())
+	}
+	return int(v % uint64(n))
+}
+
+// Read implements source.
+func (s *byteSource) Read(p []byte) (int, error) {
+	n := copy(p, s.data)
+	s.data = s.data[n:]
+	clear(p[n:])
+	return len(p), nil
+}
+
+const (
+	// the seed only determines the fuzzer's key; everything else comes from
+	// the fuzz input
+	fuzzChainSeed          = 1
+	fuzzChainAllowHeight   = 5
+	fuzzChainRequireHeight = 10
+	fuzzChainMaxBlocks     = 15
+)
+
+// FuzzChain generates a chain from the fuzz input and checks every invariant
+// that the fuzz command does. When a failing input is replayed outside of
+// fuzzing, e.g. with go test -run FuzzChain/<id>, it is also written as a
+// repro file.
+func FuzzChain(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := fuzzParams{
+			Seed:          fuzzChainSeed,
+			AllowHeight:   fuzzChainAllowHeight,
+			RequireHeight: fuzzChainRequireHeight,
+		}
+		_, pk := newRNG(p.Seed)
+		network, genesisBlock := fuzzNetwork(types.StandardUnlockHash(pk.PublicKey()), p.AllowHeight, p.RequireHeight)
+		src := &byteSource{data: data}
+		fz, err := newFuzzer(src, pk, dbConfig{}, network, genesisBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fz.Close()
+
+		s := newState(p, dbConfig{}, fz.n.network, fz.n.blocks[0])
+		err = func() (err error) {
+			defer fz.recoverPanic(&err)
+			for len(src.data) > 0 && len(s.Blocks) < fuzzChainMaxBlocks {
+				b := fz.mineBlock()
+				s.Blocks = append(s.Blocks, b)
+				s.Invalid = append(s.Invalid, fz.invalid)
+				if err := fz.checkBlock(b); err != nil {
+					return err
+				}
+			}
+			if err := fz.checkReapply(log.New(io.Discard, "", 0), s.Blocks); err != nil {
+				return err
+			}
+			return fz.checkReplay(s.Blocks)
+		}()
+		if err == nil {
+			return
+		} else if fuzz := flag.Lookup("test.fuzz"); fuzz != nil && fuzz.Value.String() != "" {
+			// the fuzzing engine saves the input itself
+			t.Fatal(err)
+		}
+
+		s.setFailure(err)
+		s.record(fz)
+		sum := sha256.Sum256(data)
+		path := fmt.Sprintf("fuzzchain-%x.json", sum[:8])
+		if werr := writeJSON(path, s); werr != nil {
+			t.Fatalf("%v (failed to write repro: %v)", err, werr)
+		}
+		t.Fatalf("%v, run `./fuzzer repro %s`", err, path)
+	})
+}
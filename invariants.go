@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+
+	"go.sia.tech/core/consensus"
+	"go.sia.tech/core/types"
+)
+
+// Invariants checked by the fuzzer. A failure is identified by the invariant
+// it violated.
+const (
+	invariantApply        = "apply"        // a generated block is rejected
+	invariantRevert       = "revert"       // a block cannot be reverted
+	invariantSupplement   = "supplement"   // supplements change across apply/revert/apply
+	invariantReapply      = "reapply"      // reverting and reapplying every block changes the state
+	invariantDifferential = "differential" // the primary and shadow stores disagree
+	invariantPanic        = "panic"        // consensus or store code panicked
+	invariantProof        = "proof"        // a tracked element's proof doesn't match the accumulator
+	invariantSupply       = "supply"       // siacoins or siafunds were created or destroyed
+	invariantPool         = "pool"         // the siafund pool or a claim doesn't match the shadow pool
+	invariantStore        = "store"        // the store's best chain doesn't match the blocks applied to it
+	invariantReplay       = "replay"       // replaying the chain on a fresh store diverges from the original run
+	invariantSymmetry     = "symmetry"     // a block's revert diffs don't mirror its apply diffs
+	invariantRoundTrip    = "roundtrip"    // a tracked proof changed across applying and reverting a block
+	invariantModel        = "model"        // the store's supplement for a block doesn't match the fuzzer's model
+	invariantChainIndex   = "chainindex"   // a tracked chain index element doesn't match the best chain
+	invariantReject       = "reject"       // a deliberately invalid transaction is accepted
+	invariantExpiration   = "expiration"   // the store's expiring contracts change across applying and reverting a block
+)
+
+// An invariantError reports that a chain violated one of the fuzzer's
+// invariants.
+type invariantError struct {
+	Invariant string
+	Height    uint64
+	Err       error
+}
+
+func (e *invariantError) Error() string {
+	return fmt.Sprintf("%s invariant violated at height %d: %v", e.Invariant, e.Height, e.Err)
+}
+
+func (e *invariantError) Unwrap() error {
+	return e.Err
+}
+
+func newInvariantError(invariant string, height uint64, err error) *invariantError {
+	if errors.Is(err, errDifferential) {
+		invariant = invariantDifferential
+	}
+	return &invariantError{
+		Invariant: invariant,
+		Height:    height,
+		Err:       err,
+	}
+}
+
+// recoverPanic reports a panic in the code under test as an invariant error.
+// It must be deferred directly.
+func (f *fuzzer) recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = newInvariantError(invariantPanic, f.n.tip().Height+1, fmt.Errorf("%v\n%s", r, debug.Stack()))
+	}
+}
+
+// checkTip runs the oracles that check the fuzzer's view of the chain against
+// the tip. It runs after every apply and revert.
+func (f *fuzzer) checkTip(height uint64) error {
+	if err := f.checkProofs(); err != nil {
+		return newInvariantError(invariantProof, height, err)
+	} else if err := f.n.checkStore(); err != nil {
+		return newInvariantError(invariantStore, height, err)
+	} else if err := f.checkChainIndices(); err != nil {
+		return newInvariantError(invariantChainIndex, height, err)
+	}
+	return nil
+}
+
+// apply applies b and runs every oracle against the result. desc describes
+// the application in errors.
+func (f *fuzzer) apply(b types.Block, desc string) (consensus.ApplyUpdate, error) {
+	height := f.n.tip().Height + 1
+	parent := f.n.tipState()
+	au, err := f.applyBlock(b)
+	if err != nil {
+		return au, newInvariantError(invariantApply, height, fmt.Errorf("failed to %s: %w", desc, err))
+	} else if err := checkSupply(parent, b, au); err != nil {
+		return au, newInvariantError(invariantSupply, height, fmt.Errorf("after applying: %w", err))
+	} else if err := f.applyPool(parent, b, au); err != nil {
+		return au, newInvariantError(invariantPool, height, fmt.Errorf("after applying: %w", err))
+	}
+	return au, f.checkTip(height)
+}
+
+// revert reverts the tip block and runs every oracle against the result.
+func (f *fuzzer) revert() (consensus.RevertUpdate, error) {
+	index := f.n.tip()
+	height := index.Height
+	b := f.n.blocks[len(f.n.blocks)-1]
+	parent := f.n.states[len(f.n.states)-2]
+	ru, err := f.revertBlock()
+	if err != nil {
+		return ru, newInvariantError(invariantRevert, height, fmt.Errorf("failed to revert block: %w", err))
+	} else if err := checkSupply(parent, b, ru); err != nil {
+		return ru, newInvariantError(invariantSupply, height, fmt.Errorf("after reverting: %w", err))
+	} else if err := f.revertPool(parent, b, ru); err != nil {
+		return ru, newInvariantError(invariantPool, height, fmt.Errorf("after reverting: %w", err))
+	} else if best, ok := f.n.store.Scratchpad().BestIndex(height); ok && best == index {
+		return ru, newInvariantError(invariantStore, height, fmt.Errorf("reverted index %v is still the best index", index))
+	}
+	return ru, f.checkTip(height)
+}
+
+// checkBlock applies b, reverts it, and applies it again, checking that the
+// revert undoes exactly what the apply did and that the tracked proofs and
+// store's tip supplements are unaffected by the round trip. Invalid
+// transactions generated alongside b are checked first.
+func (f *fuzzer) checkBlock(b types.Block) error {
+	height := f.n.tip().Height + 1
+	sp := f.n.store.Scratchpad()
+	if err := f.checkRejected(); err != nil {
+		return err
+	}
+
+	bs1 := sp.SupplementTipBlock(types.Block{})
+	proofs := f.stateElements()
+	var maxEnd uint64
+	for _, fce := range f.fces {
+		maxEnd = max(maxEnd, fce.FileContract.WindowEnd)
+	}
+	expiring := f.n.expiringIDs(maxEnd)
+	au, err := f.apply(b, "apply block")
+	if err != nil {
+		return err
+	}
+	f.history = append(f.history, f.checkpoint())
+	bs2 := sp.SupplementTipBlock(types.Block{})
+	ru, err := f.revert()
+	if err != nil {
+		return err
+	} else if err := checkSymmetry(au, ru); err != nil {
+		return newInvariantError(invariantSymmetry, height, err)
+	} else if err := compareProofs(proofs, f.stateElements()); err != nil {
+		return newInvariantError(invariantRoundTrip, height, err)
+	} else if err := compareExpirations(expiring, f.n.expiringIDs(maxEnd)); err != nil {
+		return newInvariantError(invariantExpiration, height, err)
+	} else if err := diffSupplements(f.expectedSupplement(b), sp.SupplementTipBlock(b)); err != nil {
+		// the fuzzer's elements are those of the tip again, now that the
+		// block has been reverted
+		return newInvariantError(invariantModel, height, fmt.Errorf("store supplement differs from the model: %w", err))
+	}
+	bs3 := sp.SupplementTipBlock(types.Block{})
+	if _, err := f.apply(b, "re-apply block"); err != nil {
+		return err
+	}
+	bs4 := sp.SupplementTipBlock(types.Block{})
+
+	if err := diffSupplements(bs1, bs3); err != nil {
+		return newInvariantError(invariantSupplement, height, fmt.Errorf("mismatched tip supplement before applying: %w", err))
+	} else if err := diffSupplements(bs2, bs4); err != nil {
+		return newInvariantError(invariantSupplement, height, fmt.Errorf("mismatched tip supplement after applying: %w", err))
+	}
+	return nil
+}
+
+// checkReapply reverts the supplied blocks, which must be the most recently
+// applied ones, then reapplies them and checks that the chain ends up in the
+// same state.
+func (f *fuzzer) checkReapply(log *log.Logger, blocks []types.Block) error {
+	state := f.n.tipState()
+	for range len(blocks) {
+		log.Println("Reverting:", f.n.tip())
+		if _, err := f.revert(); err != nil {
+			return err
+		}
+	}
+	for _, b := range blocks {
+		if _, err := f.apply(b, "apply block after reverting all"); err != nil {
+			return err
+		}
+		log.Println("Re-applied:", f.n.tip())
+	}
+
+	newState := f.n.tipState()
+	if state != newState {
+		return newInvariantError(invariantReapply, newState.Index.Height, fmt.Errorf("mismatched state hash after reverting all and reapplying, expected %v, got %v", state, newState))
+	}
+	return nil
+}
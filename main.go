@@ -1,29 +1,29 @@
 package main
 
 import (
-	"bytes"
-	"crypto/ed25519"
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"math"
 	"math/rand"
-	"os"
-	"reflect"
-	"sort"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"go.sia.tech/core/consensus"
 	"go.sia.tech/core/types"
-	"go.sia.tech/coreutils/chain"
 	"lukechampine.com/flagg"
 )
 
-type state struct {
-	Genesis types.Block
-	Network *consensus.Network
-
-	Blocks []types.Block
+// fuzzParams are the parameters used to generate a chain. Generation is
+// deterministic, so a chain can be rebuilt exactly from its parameters.
+type fuzzParams struct {
+	Seed          int64
+	AllowHeight   uint64
+	RequireHeight uint64
+	Blocks        uint64
+	KnownBugs     bool `json:",omitempty"` // trigger known bugs instead of avoiding them
 }
 
 func stateHash(cs consensus.State) types.Hash256 {
@@ -32,193 +32,151 @@ func stateHash(cs consensus.State) types.Hash256 {
 	return h.Sum()
 }
 
-func sortSupplement(bs *consensus.V1BlockSupplement) {
-	sort.Slice(bs.ExpiringFileContracts, func(i, j int) bool {
-		return bytes.Compare(bs.ExpiringFileContracts[i].ID[:], bs.ExpiringFileContracts[j].ID[:]) < 0
-	})
-}
+func fuzzCommand(p fuzzParams, dbc dbConfig, workers int) error {
+	if dbc.Path != "" && workers > 1 {
+		return errors.New("workers cannot share a database path")
+	}
 
-func fuzzCommand(allowHeight, requireHeight, blocks uint64) error {
-	rng := rand.New(rand.NewSource(1))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// each worker gets its own seed and repro file; the first failure stops
+	// all of them
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		wp := p
+		wp.Seed = p.Seed + int64(i)
+		reproPath := "repro.json"
+		logger := log.Default()
+		if workers > 1 {
+			reproPath = fmt.Sprintf("repro-%d.json", wp.Seed)
+			logger = log.New(log.Writer(), fmt.Sprintf("[worker %d] ", i), log.Flags())
+		}
+		wg.Go(func() {
+			if _, err := runFuzzer(ctx, wp, dbc, reproPath, logger); err != nil {
+				errs[i] = fmt.Errorf("worker %d (seed %d): %w", i, wp.Seed, err)
+				cancel()
+			}
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
 
-	seed := make([]byte, ed25519.SeedSize)
-	rng.Read(seed)
-	pk := types.NewPrivateKeyFromSeed(seed)
-	f, err := newFuzzer(rng, pk, allowHeight, requireHeight)
+// runFuzzer generates and checks a single chain, writing it to reproPath. It
+// returns early, without error or writing anything, if ctx is cancelled.
+func runFuzzer(ctx context.Context, p fuzzParams, dbc dbConfig, reproPath string, log *log.Logger) (s state, err error) {
+	log.Println("Seed:", p.Seed)
+	rng, pk := newRNG(p.Seed)
+	network, genesisBlock := fuzzNetwork(types.StandardUnlockHash(pk.PublicKey()), p.AllowHeight, p.RequireHeight)
+	f, err := newFuzzer(rng, pk, dbc, network, genesisBlock)
 	if err != nil {
-		return err
+		return state{}, err
 	}
 	defer f.Close()
+	f.knownBugs = p.KnownBugs
 
-	s := state{
-		Genesis: f.n.blocks[0],
-		Network: f.n.network,
-		Blocks:  f.n.blocks[1:], // don't include genesis
-	}
+	s = newState(p, dbc, f.n.network, f.n.blocks[0])
+	s.Blocks = f.n.blocks[1:] // don't include genesis
 
+	stopped := false
 	defer func() {
-		// write state to disk
-		file, err := os.Create("repro.json")
-		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
-
-		if err := json.NewEncoder(file).Encode(s); err != nil {
-			panic(err)
+		if stopped {
+			// the chain is incomplete and passed as far as it got
+			return
 		}
-
-		if err := recover(); err != nil {
-			panic(err)
+		// write state to disk
+		s.setFailure(err)
+		s.record(f)
+		if werr := writeJSON(reproPath, s); werr != nil {
+			err = errors.Join(err, werr)
 		}
 	}()
+	// report panics as errors so that one worker can't take down the others
+	// before they've written their repro files
+	defer f.recoverPanic(&err)
+
+	for range p.Blocks {
+		if ctx.Err() != nil {
+			log.Println("Stopping early")
+			stopped = true
+			return s, nil
+		}
 
-	for range blocks {
-		{
-			b := f.mineBlock()
-			log.Println("Mining:", f.n.tip().Height)
-			log.Printf("Block ID: %v, current state: %v", b.ID(), stateHash(f.n.tipState()))
-
-			s.Blocks = append(s.Blocks, b)
-			sp := f.n.store.Scratchpad()
-
-			bs1 := sp.SupplementTipBlock(types.Block{})
-			if err := f.applyBlock(b); err != nil {
-				return fmt.Errorf("failed to apply block: %w", err)
-			}
-			bs2 := sp.SupplementTipBlock(types.Block{})
-			f.revertBlock()
-			bs3 := sp.SupplementTipBlock(types.Block{})
-			if err := f.applyBlock(b); err != nil {
-				return fmt.Errorf("failed to re-apply block: %w", err)
-			}
-			bs4 := sp.SupplementTipBlock(types.Block{})
+		b := f.mineBlock()
+		s.Invalid = append(s.Invalid, f.invalid)
+		log.Println("Mining:", f.n.tip().Height)
+		log.Printf("Block ID: %v, current state: %v", b.ID(), stateHash(f.n.tipState()))
 
-			sortSupplement(&bs1)
-			sortSupplement(&bs2)
-			sortSupplement(&bs3)
-			sortSupplement(&bs4)
-			if !reflect.DeepEqual(bs1, bs3) || !reflect.DeepEqual(bs2, bs4) {
-				return fmt.Errorf("mismatched block supplement, run `./fuzzer repro repro.json`")
-			}
+		s.Blocks = append(s.Blocks, b)
+		if err := f.checkBlock(b); err != nil {
+			return s, fmt.Errorf("%w, run `./fuzzer repro %s`", err, reproPath)
 		}
 	}
 
 	// revert all blocks then reapply and see if we end up with same state
-	state := f.n.tipState()
-	for range len(s.Blocks) {
-		log.Println("Reverting:", f.n.tip())
-		f.revertBlock()
-	}
-	for _, b := range s.Blocks {
-		if err := f.applyBlock(b); err != nil {
-			return fmt.Errorf("failed to apply block after reverting all: %w", err)
-		}
-		log.Println("Re-applied:", f.n.tip())
+	if err := f.checkReapply(log, s.Blocks); err != nil {
+		return s, err
 	}
-
-	newState := f.n.tipState()
-	if state != newState {
-		return fmt.Errorf("mismatched state hash after reverting all and reapplying, expected %v, got %v", state, newState)
-	}
-
-	return nil
+	// replay all blocks on a fresh store and see if we end up with the same
+	// states along the way
+	return s, f.checkReplay(s.Blocks)
 }
 
-func reproCommand(path string) error {
-	file, err := os.Open(path)
+func reproCommand(path string, dbc dbConfig, regenerate bool) error {
+	s, err := readState(path)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	var s state
-	if err := json.NewDecoder(file).Decode(&s); err != nil {
+	if regenerate || len(s.Blocks) == 0 {
+		if s.Version == 0 {
+			// the generator has changed since legacy files were written, so
+			// their seed no longer produces the same chain
+			return fmt.Errorf("%s is a legacy repro file and can only be replayed, not regenerated", path)
+		} else if s.Params.Blocks == 0 {
+			return fmt.Errorf("%s does not record the parameters needed to regenerate it", path)
+		}
+		// rerun the fuzzer with the recorded parameters, writing the
+		// regenerated chain next to the original
+		log.Println("Regenerating from seed:", s.Params.Seed)
+		_, err := runFuzzer(context.Background(), s.Params, dbc, strings.TrimSuffix(path, filepath.Ext(path))+".regenerated.json", log.Default())
 		return err
 	}
 
-	store, err := chain.NewDBStore(chain.NewMemDB(), s.Network, s.Genesis, nil)
+	// replay the blocks through the same checks that the fuzzer runs
+	_, pk := newRNG(s.Params.Seed)
+	f, err := newFuzzer(rand.New(rand.NewSource(s.Params.Seed)), pk, dbc, s.Network, s.Genesis)
 	if err != nil {
 		return err
 	}
-	sp := store.Scratchpad()
-	genesisState := sp.TipState()
-
-	blocks := []types.Block{s.Genesis}
-	supplements := []consensus.V1BlockSupplement{{Transactions: make([]consensus.V1TransactionSupplement, len(s.Genesis.Transactions))}}
-	states := []consensus.State{genesisState}
+	defer f.Close()
+	s.restore(f)
 
-	apply := func(b types.Block) error {
-		cs := states[len(states)-1]
-		bs := sp.SupplementTipBlock(b)
-		if cs.Index.Height != math.MaxUint64 {
-			// don't validate genesis block
-			if err := consensus.ValidateBlock(cs, b, bs); err != nil {
+	err = func() (err error) {
+		defer f.recoverPanic(&err)
+		for i, b := range s.Blocks {
+			log.Println("Applying:", i)
+			log.Printf("Block ID: %v, current state: %v", b.ID(), stateHash(f.n.tipState()))
+			if i < len(s.Invalid) {
+				f.invalid = s.Invalid[i]
+			}
+			if err := f.checkBlock(b); err != nil {
 				return err
 			}
 		}
-
-		cs, au := consensus.ApplyBlock(cs, b, bs, b.Timestamp)
-
-		sp.AddState(cs)
-		sp.AddBlock(b, &bs)
-		sp.ApplyBlock(cs, au)
-
-		blocks = append(blocks, b)
-		supplements = append(supplements, bs)
-		states = append(states, cs)
-
-		return nil
-	}
-
-	revert := func() {
-		b := blocks[len(blocks)-1]
-		bs := supplements[len(supplements)-1]
-		prevState := states[len(states)-2]
-
-		ru := consensus.RevertBlock(prevState, b, bs)
-
-		sp.RevertBlock(prevState, ru)
-
-		blocks = blocks[:len(blocks)-1]
-		supplements = supplements[:len(supplements)-1]
-		states = states[:len(states)-1]
-	}
-
-	for i, b := range s.Blocks {
-		log.Println("Applying:", i)
-		log.Printf("Block ID: %v, current state: %v", b.ID(), stateHash(states[len(states)-1]))
-
-		bs1 := sp.SupplementTipBlock(types.Block{})
-		if err := apply(b); err != nil {
-			return fmt.Errorf("failed to apply block: %w", err)
-		}
-		bs2 := sp.SupplementTipBlock(types.Block{})
-		revert()
-		bs3 := sp.SupplementTipBlock(types.Block{})
-		if err := apply(b); err != nil {
-			return fmt.Errorf("failed to apply block: %w", err)
+		if err := f.checkReapply(log.Default(), s.Blocks); err != nil {
+			return err
 		}
-		bs4 := sp.SupplementTipBlock(types.Block{})
-
-		sortSupplement(&bs1)
-		sortSupplement(&bs2)
-		sortSupplement(&bs3)
-		sortSupplement(&bs4)
-		if !reflect.DeepEqual(bs1, bs3) || !reflect.DeepEqual(bs2, bs4) {
-			file, err := os.Create("bs.json")
-			if err != nil {
-				return err
-			}
-			defer file.Close()
+		return f.checkReplay(s.Blocks)
+	}()
 
-			if err := json.NewEncoder(file).Encode([]consensus.V1BlockSupplement{bs1, bs2, bs3, bs4}); err != nil {
-				return err
-			}
-			return fmt.Errorf("repro: mismatched block supplement, wrote bs1, bs2, bs3, bs4 to bs.json")
-		}
+	if err != nil {
+		return fmt.Errorf("repro: %w", err)
+	} else if s.Failure != nil {
+		log.Printf("Recorded %s failure did not reproduce", s.Failure.Invariant)
 	}
-
 	return nil
 }
 
@@ -231,8 +189,30 @@ func main() {
 	allowHeight := fuzzCmd.Uint64("allowHeight", 100, "v2 hardfork allow height")
 	requireHeight := fuzzCmd.Uint64("requireHeight", 150, "v2 hardfork require height")
 	blocks := fuzzCmd.Uint64("blocks", 250, "number of blocks to randomly generate")
+	seed := fuzzCmd.Int64("seed", 0, "rng seed (random if unset)")
+	workers := fuzzCmd.Int("workers", 1, "number of chains to fuzz in parallel")
+	knownBugs := fuzzCmd.Bool("knownBugs", false, "generate transactions that trigger known bugs in coreutils")
+	fuzzDB := fuzzCmd.String("db", "bolt", "chain database: memory|bolt[:path]")
+	fuzzDifferential := fuzzCmd.Bool("differential", false, "compare the chain database against the other backend after every block")
+	duration := fuzzCmd.Duration("duration", 0, "keep fuzzing fresh seeds for this long")
+	runs := fuzzCmd.Uint64("runs", 0, "keep fuzzing fresh seeds until this many runs complete")
+	corpus := fuzzCmd.String("corpus", "corpus", "directory for failing repros when fuzzing with -duration or -runs")
 
 	reproCmd := flagg.New("repro", "Reproduce crash")
+	regenerate := reproCmd.Bool("regenerate", false, "regenerate blocks from the recorded seed instead of replaying them")
+	reproDB := reproCmd.String("db", "memory", "chain database: memory|bolt[:path]")
+	reproDifferential := reproCmd.Bool("differential", false, "compare the chain database against the other backend after every block")
+
+	minimizeCmd := flagg.New("minimize", "Shrink a repro while preserving its failure")
+	minimizeOut := minimizeCmd.String("o", "", "output path (default <repro>.min.json)")
+	minimizeDB := minimizeCmd.String("db", "memory", "chain database: memory|bolt[:path]")
+	minimizeDifferential := minimizeCmd.Bool("differential", false, "compare the chain database against the other backend after every block")
+
+	exportCmd := flagg.New("export-test", "Export a repro as a standalone Go test")
+	exportPkg := exportCmd.String("pkg", "chain", "package of the generated test")
+	exportOut := exportCmd.String("o", "", "output path (default fuzz_repro_<id>_test.go)")
+
+	triageCmd := flagg.New("triage", "List the failure buckets in a corpus directory")
 
 	// construct the command hierarchy
 	tree := flagg.Tree{
@@ -240,6 +220,9 @@ func main() {
 		Sub: []flagg.Tree{
 			{Cmd: fuzzCmd},
 			{Cmd: reproCmd},
+			{Cmd: minimizeCmd},
+			{Cmd: triageCmd},
+			{Cmd: exportCmd},
 		},
 	}
 
@@ -248,16 +231,82 @@ func main() {
 	args := cmd.Args()
 	switch cmd {
 	case fuzzCmd:
-		if err := fuzzCommand(*allowHeight, *requireHeight, *blocks); err != nil {
-			panic(err)
+		// any seed, including 0, can be chosen explicitly
+		seedSet := false
+		fuzzCmd.Visit(func(f *flag.Flag) { seedSet = seedSet || f.Name == "seed" })
+		if !seedSet {
+			*seed = rand.Int63()
+		}
+		p := fuzzParams{
+			Seed:          *seed,
+			AllowHeight:   *allowHeight,
+			RequireHeight: *requireHeight,
+			Blocks:        *blocks,
+			KnownBugs:     *knownBugs,
+		}
+		if *workers < 1 {
+			log.Fatal("-workers must be at least 1")
+		}
+		dbc, err := parseDBConfig(*fuzzDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dbc.Differential = *fuzzDifferential
+		if *duration > 0 || *runs > 0 {
+			if err := campaignCommand(p, dbc, *workers, *duration, *runs, *corpus); err != nil {
+				log.Fatal(err)
+			}
+		} else if err := fuzzCommand(p, dbc, *workers); err != nil {
+			log.Fatal(err)
 		}
 	case reproCmd:
+		dbc, err := parseDBConfig(*reproDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dbc.Differential = *reproDifferential
 		for _, arg := range args {
 			log.Println("Running:", arg)
-			if err := reproCommand(arg); err != nil {
-				panic(err)
+			if err := reproCommand(arg, dbc, *regenerate); err != nil {
+				log.Fatal(err)
 			}
 		}
+	case minimizeCmd:
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+		dbc, err := parseDBConfig(*minimizeDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dbc.Differential = *minimizeDifferential
+		out := *minimizeOut
+		if out == "" {
+			out = strings.TrimSuffix(args[0], filepath.Ext(args[0])) + ".min.json"
+		}
+		if err := minimizeCommand(args[0], out, dbc); err != nil {
+			log.Fatal(err)
+		}
+	case exportCmd:
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+		if err := exportTestCommand(args[0], *exportOut, *exportPkg); err != nil {
+			log.Fatal(err)
+		}
+	case triageCmd:
+		corpus := "corpus"
+		if len(args) > 1 {
+			cmd.Usage()
+			return
+		} else if len(args) == 1 {
+			corpus = args[0]
+		}
+		if err := triageCommand(corpus); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"go.sia.tech/core/blake2b"
+	"go.sia.tech/core/types"
+)
+
+// Like the accumulator checks in oracle.go, the file Merkle trees below are
+// built from the spec rather than with the code that verifies their proofs.
+
+// segmentSize is the size of the leaves of a file's Merkle tree.
+const segmentSize = 64
+
+// segment returns the i'th segment of data, which may be short if it's the
+// last.
+func segment(data []byte, i uint64) []byte {
+	start := i * segmentSize
+	return data[start:min(start+segmentSize, uint64(len(data)))]
+}
+
+// segmentHashes returns the leaf hashes of data. A short final segment is
+// padded with zeros.
+func segmentHashes(data []byte) []types.Hash256 {
+	n := (uint64(len(data)) + segmentSize - 1) / segmentSize
+	leaves := make([]types.Hash256, n)
+	for i := range leaves {
+		buf := make([]byte, 1+segmentSize)
+		buf[0] = 0x00 // leaf hash prefix
+		copy(buf[1:], segment(data, uint64(i)))
+		leaves[i] = types.HashBytes(buf)
+	}
+	return leaves
+}
+
+// splitLeaves returns the number of leaves in the left subtree of a tree
+// with n > 1 leaves: the largest power of two less than n.
+func splitLeaves(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+func subtreeRoot(leaves []types.Hash256) types.Hash256 {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := splitLeaves(len(leaves))
+	return blake2b.SumPair(subtreeRoot(leaves[:k]), subtreeRoot(leaves[k:]))
+}
+
+func subtreeProof(leaves []types.Hash256, i uint64) []types.Hash256 {
+	if len(leaves) == 1 {
+		return nil
+	}
+	k := splitLeaves(len(leaves))
+	if i < uint64(k) {
+		return append(subtreeProof(leaves[:k], i), subtreeRoot(leaves[k:]))
+	}
+	return append(subtreeProof(leaves[k:], i-uint64(k)), subtreeRoot(leaves[:k]))
+}
+
+// fileMerkleRoot returns the Merkle root of data. An empty file has the zero
+// root.
+func fileMerkleRoot(data []byte) types.Hash256 {
+	if len(data) == 0 {
+		return types.Hash256{}
+	}
+	return subtreeRoot(segmentHashes(data))
+}
+
+// fileMerkleProof returns the proof that segment i belongs to data, ordered
+// from the leaf up.
+func fileMerkleProof(data []byte, i uint64) []types.Hash256 {
+	return subtreeProof(segmentHashes(data), i)
+}
+
+// sectorSize is the size of the sectors v2 contracts store. It's far smaller
+// than a real sector so that proofs stay cheap to build.
+const sectorSize = 16 * segmentSize
+
+// randomSectors returns fewer than maxSectors sectors of random data.
+func (f *fuzzer) randomSectors(maxSectors int) []byte {
+	data := make([]byte, f.rng.Intn(maxSectors)*sectorSize)
+	f.fillRandom(data)
+	return data
+}
+
+// randomData returns up to maxSegments segments of random data. The last
+// segment is often short.
+func (f *fuzzer) randomData(maxSegments int) []byte {
+	data := make([]byte, f.rng.Intn(maxSegments)*segmentSize+f.rng.Intn(segmentSize))
+	f.fillRandom(data)
+	return data
+}
+
+// storeFile records data under its Merkle root, so that proofs can be built
+// for any contract committing to it, and returns its size and root.
+func (f *fuzzer) storeFile(data []byte) (uint64, types.Hash256) {
+	root := fileMerkleRoot(data)
+	f.files[root] = data
+	return uint64(len(data)), root
+}
+
+// pruneFiles drops the data of contracts that have been resolved, or revised
+// to commit to other data, unless another contract still commits to it.
+func (f *fuzzer) pruneFiles() {
+	live := make(map[types.Hash256]bool)
+	for _, fce := range f.fces {
+		live[fce.FileContract.FileMerkleRoot] = true
+	}
+	for _, fce := range f.v2fces {
+		live[fce.V2FileContract.FileMerkleRoot] = true
+	}
+	for root := range f.files {
+		if !live[root] {
+			delete(f.files, root)
+		}
+	}
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+
+	"go.sia.tech/core/consensus"
+	"go.sia.tech/core/types"
+)
+
+// Transaction fields that the minimizer can remove elements from.
+const (
+	fieldSiacoinInputs = iota
+	fieldSiacoinOutputs
+	fieldSiafundInputs
+	fieldSiafundOutputs
+	fieldFileContracts
+	fieldFileContractRevisions
+	fieldResolutions // storage proofs for v1 transactions
+)
+
+// A unit is a part of a chain that the minimizer may try to remove: a whole
+// block, all of the transactions in a block, a whole transaction, or a single
+// element of a transaction. Removing a block rebuilds every later block one
+// height lower, which only preserves the failure when their heights don't
+// matter to it, e.g. when the block is empty or part of a leading prefix.
+type unit struct {
+	block int
+	txn   int // -1 for every transaction in the block, -2 for the block itself
+	v2    bool
+	field int // -1 for the whole transaction
+	index int
+}
+
+func blockUnits(blocks []types.Block) (units []unit) {
+	for i, b := range blocks {
+		units = append(units, unit{block: i, txn: -2, field: -1})
+		if len(b.Transactions) > 0 || len(b.V2Transactions()) > 0 {
+			units = append(units, unit{block: i, txn: -1, field: -1})
+		}
+	}
+	return
+}
+
+func transactionUnits(blocks []types.Block) (units []unit) {
+	for i, b := range blocks {
+		for j := range b.Transactions {
+			units = append(units, unit{block: i, txn: j, field: -1})
+		}
+		for j := range b.V2Transactions() {
+			units = append(units, unit{block: i, txn: j, v2: true, field: -1})
+		}
+	}
+	return
+}
+
+func elementUnits(blocks []types.Block) (units []unit) {
+	add := func(block, txn int, v2 bool, field, n int) {
+		for k := range n {
+			units = append(units, unit{block: block, txn: txn, v2: v2, field: field, index: k})
+		}
+	}
+	for i, b := range blocks {
+		for j, txn := range b.Transactions {
+			add(i, j, false, fieldSiacoinInputs, len(txn.SiacoinInputs))
+			add(i, j, false, fieldSiacoinOutputs, len(txn.SiacoinOutputs))
+			add(i, j, false, fieldSiafundInputs, len(txn.SiafundInputs))
+			add(i, j, false, fieldSiafundOutputs, len(txn.SiafundOutputs))
+			add(i, j, false, fieldFileContracts, len(txn.FileContracts))
+			add(i, j, false, fieldFileContractRevisions, len(txn.FileContractRevisions))
+			add(i, j, false, fieldResolutions, len(txn.StorageProofs))
+		}
+		for j, txn := range b.V2Transactions() {
+			add(i, j, true, fieldSiacoinInputs, len(txn.SiacoinInputs))
+			add(i, j, true, fieldSiacoinOutputs, len(txn.SiacoinOutputs))
+			add(i, j, true, fieldSiafundInputs, len(txn.SiafundInputs))
+			add(i, j, true, fieldSiafundOutputs, len(txn.SiafundOutputs))
+			add(i, j, true, fieldFileContracts, len(txn.FileContracts))
+			add(i, j, true, fieldFileContractRevisions, len(txn.FileContractRevisions))
+			add(i, j, true, fieldResolutions, len(txn.FileContractResolutions))
+		}
+	}
+	return
+}
+
+// sameFailure reports whether two errors violate the same invariant in the
+// same way.
+func sameFailure(a, b error) bool {
+	var ia, ib *invariantError
+	if !errors.As(a, &ia) || !errors.As(b, &ib) {
+		return false
+	}
+	return newFailure(ia).signature() == newFailure(ib).signature()
+}
+
+// A rewriter rebuilds the transactions of a chain after parts of it have been
+// removed. It tracks how IDs change, so that later transactions can be pointed
+// at the rebuilt versions of the elements they spend, and repairs
+// transactions whose parents no longer exist.
+type rewriter struct {
+	f *fuzzer
+
+	scoids map[types.SiacoinOutputID]types.SiacoinOutputID
+	sfoids map[types.SiafundOutputID]types.SiafundOutputID
+	fcids  map[types.FileContractID]types.FileContractID
+
+	// elements created and spent earlier in the block being rebuilt
+	ephemeralSCEs map[types.SiacoinOutputID]types.SiacoinElement
+	ephemeralSFEs map[types.SiafundOutputID]types.SiafundElement
+	spent         map[types.Hash256]bool
+	// contracts formed earlier in the block being rebuilt
+	formed map[types.FileContractID]bool
+}
+
+func (r *rewriter) resetBlock() {
+	r.ephemeralSCEs = make(map[types.SiacoinOutputID]types.SiacoinElement)
+	r.ephemeralSFEs = make(map[types.SiafundOutputID]types.SiafundElement)
+	r.spent = make(map[types.Hash256]bool)
+	r.formed = make(map[types.FileContractID]bool)
+}
+
+func (r *rewriter) scoid(id types.SiacoinOutputID) types.SiacoinOutputID {
+	if newID, ok := r.scoids[id]; ok {
+		return newID
+	}
+	return id
+}
+
+func (r *rewriter) sfoid(id types.SiafundOutputID) types.SiafundOutputID {
+	if newID, ok := r.sfoids[id]; ok {
+		return newID
+	}
+	return id
+}
+
+func (r *rewriter) fcid(id types.FileContractID) types.FileContractID {
+	if newID, ok := r.fcids[id]; ok {
+		return newID
+	}
+	return id
+}
+
+// spendSiacoinElement returns the unspent element with the given ID, marking
+// it as spent.
+func (r *rewriter) spendSiacoinElement(id types.SiacoinOutputID) (types.SiacoinElement, bool) {
+	sce, ok := r.f.sces[id]
+	if !ok {
+		sce, ok = r.ephemeralSCEs[id]
+	}
+	if !ok || r.spent[types.Hash256(id)] {
+		return types.SiacoinElement{}, false
+	}
+	r.spent[types.Hash256(id)] = true
+	return sce.Copy(), true
+}
+
+// spendSiafundElement returns the unspent element with the given ID, marking
+// it as spent.
+func (r *rewriter) spendSiafundElement(id types.SiafundOutputID) (types.SiafundElement, bool) {
+	sfe, ok := r.f.sfes[id]
+	if !ok {
+		sfe, ok = r.ephemeralSFEs[id]
+	}
+	if !ok || r.spent[types.Hash256(id)] {
+		return types.SiafundElement{}, false
+	}
+	r.spent[types.Hash256(id)] = true
+	return sfe.Copy(), true
+}
+
+// fundSiacoins selects additional unspent elements worth at least amount.
+func (r *rewriter) fundSiacoins(amount types.Currency) (sces []types.SiacoinElement, sum types.Currency) {
+	for _, sce := range mapValues(r.f.sces) {
+		if sum.Cmp(amount) >= 0 {
+			break
+		} else if r.spent[types.Hash256(sce.ID)] || sce.MaturityHeight > r.f.n.tip().Height {
+			continue
+		} else if _, ok := r.f.owner(sce.SiacoinOutput.Address); !ok {
+			continue // locked by a policy
+		}
+		r.spent[types.Hash256(sce.ID)] = true
+		sces = append(sces, sce.Copy())
+		sum = sum.Add(sce.SiacoinOutput.Value)
+	}
+	return
+}
+
+// fundSiafunds selects additional unspent elements worth at least amount.
+func (r *rewriter) fundSiafunds(amount uint64) (sfes []types.SiafundElement, sum uint64) {
+	for _, sfe := range mapValues(r.f.sfes) {
+		if sum >= amount {
+			break
+		} else if r.spent[types.Hash256(sfe.ID)] {
+			continue
+		}
+		r.spent[types.Hash256(sfe.ID)] = true
+		sfes = append(sfes, sfe.Copy())
+		sum += sfe.SiafundOutput.Value
+	}
+	return
+}
+
+func (r *rewriter) transaction(cs consensus.State, txn types.Transaction, dropped func(field, index int) bool) types.Transaction {
+	var have, need types.Currency
+	var haveSF, needSF uint64
+	nt := types.Transaction{
+		MinerFees:     txn.MinerFees,
+		ArbitraryData: txn.ArbitraryData,
+	}
+	for _, fee := range txn.MinerFees {
+		need = need.Add(fee)
+	}
+
+	for i, sci := range txn.SiacoinInputs {
+		sci.ParentID = r.scoid(sci.ParentID)
+		if dropped(fieldSiacoinInputs, i) {
+			continue
+		}
+		sce, ok := r.spendSiacoinElement(sci.ParentID)
+		if !ok {
+			continue // parent was removed
+		}
+		have = have.Add(sce.SiacoinOutput.Value)
+		nt.SiacoinInputs = append(nt.SiacoinInputs, sci)
+	}
+	var scos []int
+	for i, sco := range txn.SiacoinOutputs {
+		if dropped(fieldSiacoinOutputs, i) {
+			continue
+		}
+		scos = append(scos, i)
+		need = need.Add(sco.Value)
+		nt.SiacoinOutputs = append(nt.SiacoinOutputs, sco)
+	}
+	for i, sfi := range txn.SiafundInputs {
+		sfi.ParentID = r.sfoid(sfi.ParentID)
+		if dropped(fieldSiafundInputs, i) {
+			continue
+		}
+		sfe, ok := r.spendSiafundElement(sfi.ParentID)
+		if !ok {
+			continue // parent was removed
+		}
+		haveSF += sfe.SiafundOutput.Value
+		nt.SiafundInputs = append(nt.SiafundInputs, sfi)
+	}
+	var sfos []int
+	for i, sfo := range txn.SiafundOutputs {
+		if dropped(fieldSiafundOutputs, i) {
+			continue
+		}
+		sfos = append(sfos, i)
+		needSF += sfo.Value
+		nt.SiafundOutputs = append(nt.SiafundOutputs, sfo)
+	}
+	var fcs []int
+	for i, fc := range txn.FileContracts {
+		if dropped(fieldFileContracts, i) {
+			continue
+		}
+		fcs = append(fcs, i)
+		need = need.Add(fc.Payout)
+		nt.FileContracts = append(nt.FileContracts, fc)
+	}
+	for i, fcr := range txn.FileContractRevisions {
+		fcr.ParentID = r.fcid(fcr.ParentID)
+		if _, ok := r.f.fces[fcr.ParentID]; (!ok && !r.formed[fcr.ParentID]) || dropped(fieldFileContractRevisions, i) {
+			continue
+		}
+		nt.FileContractRevisions = append(nt.FileContractRevisions, fcr)
+	}
+	for i, sp := range txn.StorageProofs {
+		sp.ParentID = r.fcid(sp.ParentID)
+		fce, ok := r.f.fces[sp.ParentID]
+		if !ok || dropped(fieldResolutions, i) {
+			continue
+		} else if _, ok := r.f.files[fce.FileContract.FileMerkleRoot]; ok {
+			// the contract's ID, and so the segment it proves, may have
+			// changed
+			sp = r.f.storageProof(fce)
+		}
+		nt.StorageProofs = append(nt.StorageProofs, sp)
+	}
+
+	// rebalance, either by spending more or by adding change
+	if have.Cmp(need) < 0 {
+		sces, sum := r.fundSiacoins(need.Sub(have))
+		for _, sce := range sces {
+			owner, _ := r.f.owner(sce.SiacoinOutput.Address)
+			nt.SiacoinInputs = append(nt.SiacoinInputs, types.SiacoinInput{ParentID: sce.ID, UnlockConditions: owner.uc})
+		}
+		have = have.Add(sum)
+	}
+	if have.Cmp(need) > 0 {
+		nt.SiacoinOutputs = append(nt.SiacoinOutputs, types.SiacoinOutput{Address: r.f.actors[0].addr, Value: have.Sub(need)})
+	}
+	if haveSF < needSF {
+		sfes, sum := r.fundSiafunds(needSF - haveSF)
+		for _, sfe := range sfes {
+			owner, _ := r.f.owner(sfe.SiafundOutput.Address)
+			nt.SiafundInputs = append(nt.SiafundInputs, types.SiafundInput{ParentID: sfe.ID, UnlockConditions: owner.uc})
+		}
+		haveSF += sum
+	}
+	if haveSF > needSF {
+		nt.SiafundOutputs = append(nt.SiafundOutputs, types.SiafundOutput{Address: r.f.actors[0].addr, Value: haveSF - needSF})
+	}
+	signTransaction(cs, r.f.keys, &nt)
+
+	for j, i := range scos {
+		r.scoids[txn.SiacoinOutputID(i)] = nt.SiacoinOutputID(j)
+	}
+	for j, i := range sfos {
+		r.sfoids[txn.SiafundOutputID(i)] = nt.SiafundOutputID(j)
+	}
+	for j, i := range fcs {
+		r.fcids[txn.FileContractID(i)] = nt.FileContractID(j)
+		r.formed[nt.FileContractID(j)] = true
+	}
+	for i, sco := range nt.SiacoinOutputs {
+		id := nt.SiacoinOutputID(i)
+		r.ephemeralSCEs[id] = types.SiacoinElement{
+			ID:            id,
+			StateElement:  types.StateElement{LeafIndex: types.UnassignedLeafIndex},
+			SiacoinOutput: sco,
+		}
+	}
+	for i, sfo := range nt.SiafundOutputs {
+		id := nt.SiafundOutputID(i)
+		r.ephemeralSFEs[id] = types.SiafundElement{
+			ID:            id,
+			StateElement:  types.StateElement{LeafIndex: types.UnassignedLeafIndex},
+			SiafundOutput: sfo,
+		}
+	}
+	return nt
+}
+
+func (r *rewriter) v2Transaction(cs consensus.State, txn types.V2Transaction, dropped func(field, index int) bool) types.V2Transaction {
+	var have, need types.Currency
+	var haveSF, needSF uint64
+	nt := types.V2Transaction{
+		MinerFee:      txn.MinerFee,
+		Attestations:  txn.Attestations,
+		ArbitraryData: txn.ArbitraryData,
+	}
+	need = txn.MinerFee
+
+	for i, sci := range txn.SiacoinInputs {
+		if dropped(fieldSiacoinInputs, i) {
+			continue
+		}
+		sce, ok := r.spendSiacoinElement(r.scoid(sci.Parent.ID))
+		if !ok {
+			continue // parent was removed
+		}
+		sci.Parent = sce
+		have = have.Add(sce.SiacoinOutput.Value)
+		nt.SiacoinInputs = append(nt.SiacoinInputs, sci)
+	}
+	var scos []int
+	for i, sco := range txn.SiacoinOutputs {
+		if dropped(fieldSiacoinOutputs, i) {
+			continue
+		}
+		scos = append(scos, i)
+		need = need.Add(sco.Value)
+		nt.SiacoinOutputs = append(nt.SiacoinOutputs, sco)
+	}
+	for i, sfi := range txn.SiafundInputs {
+		if dropped(fieldSiafundInputs, i) {
+			continue
+		}
+		sfe, ok := r.spendSiafundElement(r.sfoid(sfi.Parent.ID))
+		if !ok {
+			continue // parent was removed
+		}
+		sfi.Parent = sfe
+		haveSF += sfe.SiafundOutput.Value
+		nt.SiafundInputs = append(nt.SiafundInputs, sfi)
+	}
+	var sfos []int
+	for i, sfo := range txn.SiafundOutputs {
+		if dropped(fieldSiafundOutputs, i) {
+			continue
+		}
+		sfos = append(sfos, i)
+		needSF += sfo.Value
+		nt.SiafundOutputs = append(nt.SiafundOutputs, sfo)
+	}
+	var fcs []int
+	for i, fc := range txn.FileContracts {
+		if dropped(fieldFileContracts, i) {
+			continue
+		}
+		fcs = append(fcs, i)
+		need = need.Add(payoutV2(fc))
+		nt.FileContracts = append(nt.FileContracts, fc)
+	}
+	for i, fcr := range txn.FileContractRevisions {
+		fce, ok := r.f.v2fces[r.fcid(fcr.Parent.ID)]
+		if !ok || dropped(fieldFileContractRevisions, i) {
+			continue
+		}
+		fcr.Parent = fce.Copy()
+		nt.FileContractRevisions = append(nt.FileContractRevisions, fcr)
+	}
+	renewals := make(map[types.FileContractID]types.FileContractID)
+	for i, fcr := range txn.FileContractResolutions {
+		oldID := fcr.Parent.ID
+		fce, ok := r.f.v2fces[r.fcid(oldID)]
+		if !ok || dropped(fieldResolutions, i) {
+			continue
+		}
+		fcr.Parent = fce.Copy()
+		switch res := fcr.Resolution.(type) {
+		case *types.V2FileContractRenewal:
+			renewal := *res
+			fcr.Resolution = &renewal
+			have = have.Add(renewal.RenterRollover).Add(renewal.HostRollover)
+			need = need.Add(payoutV2(renewal.NewContract))
+			renewals[oldID.V2RenewalID()] = fce.ID.V2RenewalID()
+		case *types.V2StorageProof:
+			// the contract's ID, and so the segment it proves, may have
+			// changed
+			if _, ok := r.f.files[fce.V2FileContract.FileMerkleRoot]; ok && fce.V2FileContract.ProofHeight < uint64(len(r.f.cies)) {
+				fcr.Resolution = r.f.v2StorageProof(fce)
+				break
+			}
+			sp := *res
+			if h := sp.ProofIndex.ChainIndex.Height; h < uint64(len(r.f.cies)) {
+				sp.ProofIndex = r.f.cies[h].Copy()
+			}
+			fcr.Resolution = &sp
+		}
+		nt.FileContractResolutions = append(nt.FileContractResolutions, fcr)
+	}
+
+	// rebalance, either by spending more or by adding change
+	if have.Cmp(need) < 0 {
+		sces, sum := r.fundSiacoins(need.Sub(have))
+		for _, sce := range sces {
+			owner, _ := r.f.owner(sce.SiacoinOutput.Address)
+			nt.SiacoinInputs = append(nt.SiacoinInputs, types.V2SiacoinInput{
+				Parent:          sce,
+				SatisfiedPolicy: types.SatisfiedPolicy{Policy: owner.policy},
+			})
+		}
+		have = have.Add(sum)
+	}
+	if have.Cmp(need) > 0 {
+		nt.SiacoinOutputs = append(nt.SiacoinOutputs, types.SiacoinOutput{Address: r.f.actors[0].addr, Value: have.Sub(need)})
+	}
+	if haveSF < needSF {
+		sfes, sum := r.fundSiafunds(needSF - haveSF)
+		for _, sfe := range sfes {
+			owner, _ := r.f.owner(sfe.SiafundOutput.Address)
+			nt.SiafundInputs = append(nt.SiafundInputs, types.V2SiafundInput{
+				Parent:          sfe,
+				SatisfiedPolicy: types.SatisfiedPolicy{Policy: owner.policy},
+			})
+		}
+		haveSF += sum
+	}
+	if haveSF > needSF {
+		nt.SiafundOutputs = append(nt.SiafundOutputs, types.SiafundOutput{Address: r.f.actors[0].addr, Value: haveSF - needSF})
+	}
+	signV2Transaction(cs, r.f.keys, &nt)
+
+	oldID, newID := txn.ID(), nt.ID()
+	for j, i := range scos {
+		r.scoids[txn.SiacoinOutputID(oldID, i)] = nt.SiacoinOutputID(newID, j)
+	}
+	for j, i := range sfos {
+		r.sfoids[txn.SiafundOutputID(oldID, i)] = nt.SiafundOutputID(newID, j)
+	}
+	for j, i := range fcs {
+		r.fcids[txn.V2FileContractID(oldID, i)] = nt.V2FileContractID(newID, j)
+	}
+	for oldID, newID := range renewals {
+		r.fcids[oldID] = newID
+	}
+	for i := range nt.SiacoinOutputs {
+		sce := nt.EphemeralSiacoinOutput(i)
+		r.ephemeralSCEs[sce.ID] = sce
+	}
+	for i := range nt.SiafundOutputs {
+		sfe := nt.EphemeralSiafundOutput(i)
+		r.ephemeralSFEs[sfe.ID] = sfe
+	}
+	return nt
+}
+
+// A minimizer shrinks a failing chain while preserving its failure.
+type minimizer struct {
+	s     state
+	pk    types.PrivateKey
+	dbc   dbConfig
+	log   *log.Logger
+	tests int
+
+	target  error
+	invalid [][]invalidTxn // replayed alongside the blocks for reject failures
+}
+
+// rebuild replays blocks with the units in drop removed, re-signing and
+// re-mining each block, and checks every invariant along the way. It returns
+// the rebuilt blocks, and the invalid transactions replayed alongside them, up
+// to and including the first failure.
+func (m *minimizer) rebuild(blocks []types.Block, drop map[unit]bool) (rebuilt []types.Block, invalid [][]invalidTxn, err error) {
+	m.tests++
+	// the rng is unused; all of the randomness is already in the blocks
+	f, err := newFuzzer(rand.New(rand.NewSource(0)), m.pk, m.dbc, m.s.Network, m.s.Genesis)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	m.s.restore(f)
+
+	defer f.recoverPanic(&err)
+
+	r := &rewriter{
+		f:      f,
+		scoids: make(map[types.SiacoinOutputID]types.SiacoinOutputID),
+		sfoids: make(map[types.SiafundOutputID]types.SiafundOutputID),
+		fcids:  make(map[types.FileContractID]types.FileContractID),
+	}
+	for i, b := range blocks {
+		if drop[unit{block: i, txn: -2, field: -1}] {
+			// the rewriter repairs later transactions that spent what it
+			// created, as it does for removed transactions
+			continue
+		}
+		r.resetBlock()
+
+		// skip transactions that are no longer allowed at this height
+		cs := f.n.tipState()
+		cleared := drop[unit{block: i, txn: -1, field: -1}]
+		allowV1 := !cleared && cs.Index.Height < cs.Network.HardforkV2.RequireHeight-1
+		allowV2 := !cleared && cs.Index.Height >= cs.Network.HardforkV2.AllowHeight
+		var txns []types.Transaction
+		for j, txn := range b.Transactions {
+			if !allowV1 || drop[unit{block: i, txn: j, field: -1}] {
+				continue
+			}
+			txns = append(txns, r.transaction(cs, txn, func(field, index int) bool {
+				return drop[unit{block: i, txn: j, field: field, index: index}]
+			}))
+		}
+		var v2Txns []types.V2Transaction
+		for j, txn := range b.V2Transactions() {
+			if !allowV2 || drop[unit{block: i, txn: j, v2: true, field: -1}] {
+				continue
+			}
+			v2Txns = append(v2Txns, r.v2Transaction(cs, txn, func(field, index int) bool {
+				return drop[unit{block: i, txn: j, v2: true, field: field, index: index}]
+			}))
+		}
+
+		nb := mineBlock(cs, txns, v2Txns, types.VoidAddress)
+		rebuilt = append(rebuilt, nb)
+		if i < len(m.invalid) {
+			f.invalid = m.invalid[i]
+			invalid = append(invalid, m.invalid[i])
+		}
+		if err := f.checkBlock(nb); err != nil {
+			return rebuilt, invalid, err
+		}
+	}
+	if err := f.checkReapply(log.New(io.Discard, "", 0), rebuilt); err != nil {
+		return rebuilt, invalid, err
+	}
+	return rebuilt, invalid, f.checkReplay(rebuilt)
+}
+
+// reduce removes as many of the units returned by enumerate as possible
+// using delta debugging.
+func (m *minimizer) reduce(name string, blocks []types.Block, enumerate func([]types.Block) []unit) []types.Block {
+	units := enumerate(blocks)
+	n := 2
+	for len(units) > 0 {
+		chunk := (len(units) + n - 1) / n
+		reduced := false
+		for start := 0; start < len(units); start += chunk {
+			drop := make(map[unit]bool)
+			for _, u := range units[start:min(start+chunk, len(units))] {
+				drop[u] = true
+			}
+			// repairs may add elements back, so only accept a strictly
+			// smaller chain
+			rebuilt, invalid, err := m.rebuild(blocks, drop)
+			if !sameFailure(err, m.target) || len(enumerate(rebuilt)) >= len(units) {
+				continue
+			}
+			blocks, m.invalid = rebuilt, invalid
+			prev := len(units)
+			units = enumerate(blocks)
+			m.log.Printf("%s: %d -> %d (%d blocks, %d tests)", name, prev, len(units), len(blocks), m.tests)
+			n = max(n-1, 2)
+			reduced = true
+			break
+		}
+		if !reduced {
+			if n >= len(units) {
+				break
+			}
+			n = min(n*2, len(units))
+		}
+	}
+	return blocks
+}
+
+func minimizeCommand(path, outPath string, dbc dbConfig) error {
+	s, err := readState(path)
+	if err != nil {
+		return err
+	}
+
+	_, pk := newRNG(s.Params.Seed)
+	m := &minimizer{
+		s:   s,
+		pk:  pk,
+		dbc: dbc,
+		log: log.Default(),
+	}
+
+	// find the failure we're trying to preserve. Rebuilding without dropping
+	// anything must fail the same way the recorded chain did; otherwise the
+	// failure may have been introduced by the rewriter itself.
+	if s.Failure == nil {
+		return fmt.Errorf("%s does not record a failure", path)
+	} else if s.Failure.Invariant == invariantReject {
+		// the invalid transactions aren't rewritten, so they're only worth
+		// replaying if they're what failed
+		m.invalid = s.Invalid
+	}
+	blocks, invalid, err := m.rebuild(s.Blocks, nil)
+	var ie *invariantError
+	if err == nil {
+		return fmt.Errorf("%s does not fail", path)
+	} else if !errors.As(err, &ie) {
+		return err
+	} else if newFailure(err).signature() != s.Failure.signature() {
+		return fmt.Errorf("rebuilding %s fails with %v, not its recorded %s failure", path, err, s.Failure.Invariant)
+	}
+	m.target, m.invalid = err, invalid
+	log.Printf("Minimizing %v (%d blocks)", err, len(blocks))
+
+	// keep going until no level makes progress
+	for {
+		prev := len(blocks)
+		prevTxns := len(transactionUnits(blocks))
+		prevElems := len(elementUnits(blocks))
+		blocks = m.reduce("blocks", blocks, blockUnits)
+		blocks = m.reduce("transactions", blocks, transactionUnits)
+		blocks = m.reduce("elements", blocks, elementUnits)
+		if len(blocks) == prev && len(transactionUnits(blocks)) == prevTxns && len(elementUnits(blocks)) == prevElems {
+			break
+		}
+	}
+
+	// the minimized chain can no longer be regenerated from its seed
+	s.Version = reproVersion
+	s.Versions = currentVersions()
+	s.Params.Blocks = 0
+	s.Blocks = blocks
+	s.Invalid = m.invalid
+	s.setFailure(m.target)
+	if err := writeJSON(outPath, s); err != nil {
+		return err
+	}
+	log.Printf("Wrote %d blocks, %d transactions to %s after %d tests", len(blocks), len(transactionUnits(blocks)), outPath, m.tests)
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"go.sia.tech/core/blake2b"
+	"go.sia.tech/core/consensus"
+	"go.sia.tech/core/types"
+)
+
+// The accumulator's membership checks are unexported, so the oracles below
+// reimplement them from the consensus spec rather than trusting the code that
+// produced the proofs.
+
+// leafHash returns the hash of an accumulator leaf.
+func leafHash(elemHash types.Hash256, leafIndex uint64, spent bool) types.Hash256 {
+	buf := make([]byte, 1+32+8+1)
+	buf[0] = 0x00 // leaf hash prefix
+	copy(buf[1:], elemHash[:])
+	binary.LittleEndian.PutUint64(buf[33:], leafIndex)
+	if spent {
+		buf[41] = 1
+	}
+	return types.HashBytes(buf)
+}
+
+// accumulatorContains reports whether the accumulator contains the leaf with
+// the supplied element hash and spent status.
+func accumulatorContains(acc consensus.ElementAccumulator, se types.StateElement, elemHash types.Hash256, spent bool) bool {
+	height := len(se.MerkleProof)
+	if height >= len(acc.Trees) || acc.NumLeaves&(1<<height) == 0 {
+		return false
+	}
+	root := leafHash(elemHash, se.LeafIndex, spent)
+	for i, h := range se.MerkleProof {
+		if se.LeafIndex&(1<<i) == 0 {
+			root = blake2b.SumPair(root, h)
+		} else {
+			root = blake2b.SumPair(h, root)
+		}
+	}
+	return acc.Trees[height] == root
+}
+
+func siacoinElementHash(sce types.SiacoinElement) types.Hash256 {
+	h := types.NewHasher()
+	h.WriteDistinguisher("leaf/siacoin")
+	sce.ID.EncodeTo(h.E)
+	types.V2SiacoinOutput(sce.SiacoinOutput).EncodeTo(h.E)
+	h.E.WriteUint64(sce.MaturityHeight)
+	return h.Sum()
+}
+
+func siafundElementHash(sfe types.SiafundElement) types.Hash256 {
+	h := types.NewHasher()
+	h.WriteDistinguisher("leaf/siafund")
+	sfe.ID.EncodeTo(h.E)
+	types.V2SiafundOutput(sfe.SiafundOutput).EncodeTo(h.E)
+	types.V2Currency(sfe.ClaimStart).EncodeTo(h.E)
+	return h.Sum()
+}
+
+func fileContractElementHash(fce types.FileContractElement) types.Hash256 {
+	h := types.NewHasher()
+	h.WriteDistinguisher("leaf/filecontract")
+	fce.ID.EncodeTo(h.E)
+	fce.FileContract.EncodeTo(h.E)
+	return h.Sum()
+}
+
+func v2FileContractElementHash(fce types.V2FileContractElement) types.Hash256 {
+	h := types.NewHasher()
+	h.WriteDistinguisher("leaf/v2filecontract")
+	fce.ID.EncodeTo(h.E)
+	fce.V2FileContract.EncodeTo(h.E)
+	return h.Sum()
+}
+
+func chainIndexElementHash(cie types.ChainIndexElement) types.Hash256 {
+	h := types.NewHasher()
+	h.WriteDistinguisher("leaf/chainindex")
+	cie.ID.EncodeTo(h.E)
+	cie.ChainIndex.EncodeTo(h.E)
+	return h.Sum()
+}
+
+// checkProof checks that an element the fuzzer tracks as live (unspent or
+// unresolved) is in the accumulator as such.
+func checkProof(acc consensus.ElementAccumulator, kind string, id types.Hash256, se types.StateElement, elemHash types.Hash256) error {
+	if se.LeafIndex == types.UnassignedLeafIndex {
+		return fmt.Errorf("%s %v has no leaf index", kind, id)
+	} else if accumulatorContains(acc, se, elemHash, false) {
+		return nil
+	} else if accumulatorContains(acc, se, elemHash, true) {
+		return fmt.Errorf("%s %v (leaf %d) is tracked as live but its proof shows it spent", kind, id, se.LeafIndex)
+	}
+	return fmt.Errorf("%s %v (leaf %d) has an invalid proof (%d hashes, %d leaves in accumulator)", kind, id, se.LeafIndex, len(se.MerkleProof), acc.NumLeaves)
+}
+
+// checkProofs checks the proof of every element the fuzzer tracks, other than
+// chain index elements, against the tip state's accumulator.
+func (f *fuzzer) checkProofs() error {
+	acc := f.n.tipState().Elements
+	for _, sce := range mapValues(f.sces) {
+		if err := checkProof(acc, "siacoin element", types.Hash256(sce.ID), sce.StateElement, siacoinElementHash(sce)); err != nil {
+			return err
+		}
+	}
+	for _, sfe := range mapValues(f.sfes) {
+		if err := checkProof(acc, "siafund element", types.Hash256(sfe.ID), sfe.StateElement, siafundElementHash(sfe)); err != nil {
+			return err
+		}
+	}
+	for _, fce := range mapValues(f.fces) {
+		if err := checkProof(acc, "file contract", types.Hash256(fce.ID), fce.StateElement, fileContractElementHash(fce)); err != nil {
+			return err
+		}
+	}
+	for _, fce := range mapValues(f.v2fces) {
+		if err := checkProof(acc, "v2 file contract", types.Hash256(fce.ID), fce.StateElement, v2FileContractElementHash(fce)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkChainIndices checks that the fuzzer tracks one chain index element per
+// block of the best chain, each with a valid proof. v2 storage proofs are
+// built from these.
+func (f *fuzzer) checkChainIndices() error {
+	tip := f.n.tip()
+	if uint64(len(f.cies)) != tip.Height+1 {
+		return fmt.Errorf("tracking %d chain index elements, expected %d", len(f.cies), tip.Height+1)
+	}
+	sp := f.n.store.Scratchpad()
+	acc := f.n.tipState().Elements
+	for h, cie := range f.cies {
+		best, ok := sp.BestIndex(uint64(h))
+		if !ok {
+			return fmt.Errorf("no best index at height %d", h)
+		} else if cie.ChainIndex != best {
+			return fmt.Errorf("chain index element at height %d is %v, expected %v", h, cie.ChainIndex, best)
+		} else if cie.ID != cie.ChainIndex.ID {
+			return fmt.Errorf("chain index element at height %d has ID %v, expected %v", h, cie.ID, cie.ChainIndex.ID)
+		} else if err := checkProof(acc, "chain index element", types.Hash256(cie.ID), cie.StateElement, chainIndexElementHash(cie)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stateElements returns a copy of the state element of every element the
+// fuzzer tracks, keyed by element ID. Elements created by transactions that
+// haven't been mined yet have no leaf and are skipped.
+func (f *fuzzer) stateElements() map[types.Hash256]types.StateElement {
+	m := make(map[types.Hash256]types.StateElement)
+	add := func(id types.Hash256, se types.StateElement) {
+		if se.LeafIndex != types.UnassignedLeafIndex {
+			m[id] = se.Copy()
+		}
+	}
+	for id, sce := range f.sces {
+		add(types.Hash256(id), sce.StateElement)
+	}
+	for id, sfe := range f.sfes {
+		add(types.Hash256(id), sfe.StateElement)
+	}
+	for id, fce := range f.fces {
+		add(types.Hash256(id), fce.StateElement)
+	}
+	for id, fce := range f.v2fces {
+		add(types.Hash256(id), fce.StateElement)
+	}
+	for _, cie := range f.cies {
+		add(types.Hash256(cie.ID), cie.StateElement)
+	}
+	return m
+}
+
+// compareProofs checks that every element in before is still tracked after
+// a block was applied and reverted, with the same leaf index and proof.
+func compareProofs(before, after map[types.Hash256]types.StateElement) error {
+	var errs []string
+	for _, id := range mapKeys(before) {
+		want := before[id]
+		got, ok := after[id]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("element %v (leaf %d) is no longer tracked", id, want.LeafIndex))
+		} else if got.LeafIndex != want.LeafIndex {
+			errs = append(errs, fmt.Sprintf("element %v moved from leaf %d to %d", id, want.LeafIndex, got.LeafIndex))
+		} else if len(got.MerkleProof) != len(want.MerkleProof) {
+			errs = append(errs, fmt.Sprintf("element %v (leaf %d) has a proof of %d hashes, expected %d", id, want.LeafIndex, len(got.MerkleProof), len(want.MerkleProof)))
+		} else {
+			for i := range want.MerkleProof {
+				if got.MerkleProof[i] != want.MerkleProof[i] {
+					errs = append(errs, fmt.Sprintf("element %v (leaf %d) has a different proof hash at height %d", id, want.LeafIndex, i))
+					break
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d proofs changed across apply and revert:\n\t%s", len(errs), strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"time"
+
+	"go.sia.tech/core/types"
+)
+
+// A lock is a v2 spend policy the fuzzer knows how to satisfy. Outputs sent
+// to the address of policy are tracked like those of actors.
+type lock struct {
+	Policy    types.SpendPolicy
+	Satisfied types.SpendPolicy // Policy, with the branches the spend skips made opaque
+	Preimages [][32]byte        // in the order Satisfied checks them
+	Height    uint64            // the lowest parent height Satisfied accepts
+	After     time.Time         // Satisfied needs a median timestamp after this
+}
+
+// spendable reports whether l can be satisfied in the child of a block at
+// height. Block timestamps never advance, so the median timestamp is always
+// blockTimestamp.
+func (l lock) spendable(height uint64) bool {
+	return height >= l.Height && blockTimestamp.After(l.After)
+}
+
+// timelockErrors returns the errors consensus reports for the timelocks of l
+// that keep it from being satisfied at height.
+func (l lock) timelockErrors(height uint64) (errs []string) {
+	if height < l.Height {
+		errs = append(errs, "not above")
+	}
+	if !blockTimestamp.After(l.After) {
+		errs = append(errs, "not after")
+	}
+	return
+}
+
+// newLock returns a random lock. Thresholds nest up to depth levels deep.
+func (f *fuzzer) newLock(depth int) lock {
+	height := f.n.tip().Height
+	if depth > 0 && f.rng.Intn(2) == 0 {
+		return f.newThresholdLock(depth)
+	}
+	switch f.rng.Intn(4) {
+	case 0:
+		p := types.PolicyPublicKey(f.randomActor().pk.PublicKey())
+		return lock{Policy: p, Satisfied: p}
+	case 1:
+		var preimage [32]byte
+		f.fillRandom(preimage[:])
+		p := types.PolicyHash(sha256.Sum256(preimage[:]))
+		return lock{Policy: p, Satisfied: p, Preimages: [][32]byte{preimage}}
+	case 2:
+		// some are spendable right away, others only a few blocks later
+		h := height + uint64(f.rng.Intn(10))
+		p := types.PolicyAbove(h)
+		return lock{Policy: p, Satisfied: p, Height: h}
+	default:
+		// a quarter never unlock, since timestamps don't advance
+		t := blockTimestamp.Add(time.Duration(f.rng.Intn(4)-3) * time.Hour)
+		p := types.PolicyAfter(t)
+		return lock{Policy: p, Satisfied: p, After: t}
+	}
+}
+
+// newThresholdLock returns a lock requiring n of up to three random
+// sub-locks. The spend satisfies n of them chosen at random; the rest are
+// revealed only as opaque hashes.
+func (f *fuzzer) newThresholdLock(depth int) lock {
+	subs := make([]lock, 1+f.rng.Intn(3))
+	for i := range subs {
+		subs[i] = f.newLock(depth - 1)
+	}
+	n := 1 + f.rng.Intn(len(subs))
+	used := make(map[int]bool)
+	for _, i := range randPerm(f.rng, len(subs))[:n] {
+		used[i] = true
+	}
+
+	var l lock
+	var of, satisfiedOf []types.SpendPolicy
+	for i, sub := range subs {
+		of = append(of, sub.Policy)
+		if !used[i] {
+			satisfiedOf = append(satisfiedOf, types.PolicyOpaque(sub.Policy))
+			continue
+		}
+		satisfiedOf = append(satisfiedOf, sub.Satisfied)
+		l.Preimages = append(l.Preimages, sub.Preimages...)
+		l.Height = max(l.Height, sub.Height)
+		if sub.After.After(l.After) {
+			l.After = sub.After
+		}
+	}
+	if f.rng.Intn(4) == 0 {
+		// a branch that was only ever known by its hash
+		opaque := types.PolicyOpaque(types.PolicyPublicKey(f.randomActor().pk.PublicKey()))
+		of = append(of, opaque)
+		satisfiedOf = append(satisfiedOf, opaque)
+	}
+	l.Policy = types.PolicyThreshold(uint8(n), of)
+	l.Satisfied = types.PolicyThreshold(uint8(n), satisfiedOf)
+	return l
+}
+
+func randPerm(rng source, n int) []int {
+	p := make([]int, n)
+	for i := range p {
+		j := rng.Intn(i + 1)
+		p[i], p[j] = p[j], i
+	}
+	return p
+}
+
+// v2OutputAddress returns the address of a random actor or, sometimes, of a
+// new lock.
+func (f *fuzzer) v2OutputAddress() types.Address {
+	if f.rng.Intn(4) != 0 {
+		return f.randomActor().addr
+	}
+	l := f.newLock(2)
+	addr := l.Policy.Address()
+	f.locks[addr] = l
+	return addr
+}
+
+// spendPolicy returns the unsigned policy that spends an element sent to addr
+// in the child of the tip, or false if the fuzzer can't spend it there.
+func (f *fuzzer) spendPolicy(addr types.Address) (types.SatisfiedPolicy, bool) {
+	if a, ok := f.owner(addr); ok {
+		return types.SatisfiedPolicy{Policy: a.policy}, true
+	} else if l, ok := f.locks[addr]; ok && l.spendable(f.n.tip().Height) {
+		return types.SatisfiedPolicy{Policy: l.Satisfied, Preimages: l.Preimages}, true
+	}
+	return types.SatisfiedPolicy{}, false
+}
+
+// generateTimelockSpends queues transactions that spend locked elements
+// before their timelocks expire. Each must be rejected.
+func (f *fuzzer) generateTimelockSpends() {
+	height := f.n.tip().Height
+	count := f.rng.Intn(3)
+	for _, sce := range mapValues(f.sces) {
+		if count == 0 {
+			break
+		}
+		l, ok := f.locks[sce.SiacoinOutput.Address]
+		if !ok || l.spendable(height) || sce.StateElement.LeafIndex == types.UnassignedLeafIndex {
+			continue
+		}
+		txn := types.V2Transaction{
+			SiacoinInputs: []types.V2SiacoinInput{{
+				Parent:          sce.Copy(),
+				SatisfiedPolicy: types.SatisfiedPolicy{Policy: l.Satisfied, Preimages: l.Preimages},
+			}},
+			SiacoinOutputs: []types.SiacoinOutput{{
+				Address: f.randomActor().addr,
+				Value:   sce.SiacoinOutput.Value,
+			}},
+		}
+		signV2Transaction(f.n.tipState(), f.keys, &txn)
+		errs := l.timelockErrors(height)
+		f.invalid = append(f.invalid, invalidTxn{
+			Desc:   "spend of " + l.Policy.String() + " before its timelock expired",
+			Errs:   errs,
+			V2Txns: []types.V2Transaction{txn},
+		})
+		count--
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+
+	"go.sia.tech/core/consensus"
+	"go.sia.tech/core/types"
+)
+
+// siafundCount is the fixed number of siafunds that share the pool.
+const siafundCount = 10000
+
+// fileContractTax returns the pool tax on a v1 contract formed in the child of
+// cs.
+func fileContractTax(cs consensus.State, fc types.FileContract) types.Currency {
+	payout := fc.Payout.Big()
+	var tax *big.Int
+	if cs.Index.Height+1 < cs.Network.HardforkTax.Height {
+		// before the hardfork, the rate was applied as a float
+		r := new(big.Rat).Mul(new(big.Rat).SetInt(payout), new(big.Rat).SetFloat64(0.039))
+		tax = new(big.Int).Quo(r.Num(), r.Denom())
+	} else {
+		tax = new(big.Int).Mul(payout, big.NewInt(39))
+		tax.Quo(tax, big.NewInt(1000))
+	}
+	// the tax is rounded down so that it divides evenly among siafunds
+	tax.Sub(tax, new(big.Int).Mod(tax, big.NewInt(siafundCount)))
+	return types.NewCurrency(tax.Uint64(), new(big.Int).Rsh(tax, 64).Uint64())
+}
+
+// v2FileContractTax returns the pool tax on a v2 contract: 4% of its
+// outputs.
+func v2FileContractTax(fc types.V2FileContract) types.Currency {
+	return fc.RenterOutput.Value.Add(fc.HostOutput.Value).Div64(25)
+}
+
+// blockTax returns the pool tax on every contract b forms, including
+// renewals.
+func blockTax(parent consensus.State, b types.Block) (tax types.Currency) {
+	for _, txn := range b.Transactions {
+		for _, fc := range txn.FileContracts {
+			tax = tax.Add(fileContractTax(parent, fc))
+		}
+	}
+	for _, txn := range b.V2Transactions() {
+		for _, fc := range txn.FileContracts {
+			tax = tax.Add(v2FileContractTax(fc))
+		}
+		for _, fcr := range txn.FileContractResolutions {
+			if r, ok := fcr.Resolution.(*types.V2FileContractRenewal); ok {
+				tax = tax.Add(v2FileContractTax(r.NewContract))
+			}
+		}
+	}
+	return
+}
+
+// simulatePool replays the siafund pool through b, starting from pool. It
+// returns the claim owed to each spent siafund element, keyed by the ID of
+// its claim output, and the pool after the block. v1 siafund elements are
+// looked up in sfes, since v1 inputs don't carry their parent.
+func simulatePool(parent consensus.State, pool types.Currency, b types.Block, sfes []consensus.SiafundElementDiff) (map[types.SiacoinOutputID]types.Currency, types.Currency, error) {
+	spent := make(map[types.SiafundOutputID]types.SiafundElement)
+	for _, diff := range sfes {
+		spent[diff.SiafundElement.ID] = diff.SiafundElement
+	}
+	claims := make(map[types.SiacoinOutputID]types.Currency)
+	claim := func(id types.SiacoinOutputID, sfe types.SiafundElement) error {
+		delta, underflow := pool.SubWithUnderflow(sfe.ClaimStart)
+		if underflow {
+			return fmt.Errorf("siafund element %v has claim start %v above the pool (%v)", sfe.ID, sfe.ClaimStart, pool)
+		}
+		claims[id] = delta.Div64(siafundCount).Mul64(sfe.SiafundOutput.Value)
+		return nil
+	}
+
+	// claims are paid from the pool as it stands when the input is spent,
+	// which includes the tax on contracts formed earlier in the block
+	for _, txn := range b.Transactions {
+		for _, sfi := range txn.SiafundInputs {
+			sfe, ok := spent[sfi.ParentID]
+			if !ok {
+				return nil, types.ZeroCurrency, fmt.Errorf("siafund input %v has no element diff", sfi.ParentID)
+			} else if err := claim(sfi.ParentID.ClaimOutputID(), sfe); err != nil {
+				return nil, types.ZeroCurrency, err
+			}
+		}
+		for _, fc := range txn.FileContracts {
+			pool = pool.Add(fileContractTax(parent, fc))
+		}
+	}
+	for _, txn := range b.V2Transactions() {
+		for _, sfi := range txn.SiafundInputs {
+			if err := claim(sfi.Parent.ID.V2ClaimOutputID(), sfi.Parent); err != nil {
+				return nil, types.ZeroCurrency, err
+			}
+		}
+		for _, fc := range txn.FileContracts {
+			pool = pool.Add(v2FileContractTax(fc))
+		}
+		for _, fcr := range txn.FileContractResolutions {
+			if r, ok := fcr.Resolution.(*types.V2FileContractRenewal); ok {
+				pool = pool.Add(v2FileContractTax(r.NewContract))
+			}
+		}
+	}
+	return claims, pool, nil
+}
+
+// checkClaims checks that every claim output in claims was created by u with
+// the expected value.
+func checkClaims(claims map[types.SiacoinOutputID]types.Currency, u update) error {
+	created := make(map[types.SiacoinOutputID]types.SiacoinOutput)
+	for _, diff := range u.SiacoinElementDiffs() {
+		if diff.Created {
+			created[diff.SiacoinElement.ID] = diff.SiacoinElement.SiacoinOutput
+		}
+	}
+	for id, value := range claims {
+		sco, ok := created[id]
+		if !ok {
+			return fmt.Errorf("siafund claim output %v was not created", id)
+		} else if sco.Value != value {
+			return fmt.Errorf("siafund claim output %v has value %v, expected %v", id, sco.Value, value)
+		}
+	}
+	return nil
+}
+
+// applyPool advances the shadow siafund pool through b, which was applied to
+// parent with update au, and checks it against the tip.
+func (f *fuzzer) applyPool(parent consensus.State, b types.Block, au consensus.ApplyUpdate) error {
+	claims, pool, err := simulatePool(parent, f.pool, b, au.SiafundElementDiffs())
+	if err != nil {
+		return err
+	}
+	f.pool = pool
+	return f.checkPool(claims, au)
+}
+
+// revertPool rewinds the shadow siafund pool through b, which was reverted
+// to parent with update ru, and checks it against the tip.
+func (f *fuzzer) revertPool(parent consensus.State, b types.Block, ru consensus.RevertUpdate) error {
+	pool, underflow := f.pool.SubWithUnderflow(blockTax(parent, b))
+	if underflow {
+		return fmt.Errorf("block tax %v exceeds the pool (%v)", blockTax(parent, b), f.pool)
+	}
+	claims, _, err := simulatePool(parent, pool, b, ru.SiafundElementDiffs())
+	if err != nil {
+		return err
+	}
+	f.pool = pool
+	return f.checkPool(claims, ru)
+}
+
+func (f *fuzzer) checkPool(claims map[types.SiacoinOutputID]types.Currency, u update) error {
+	if cs := f.n.tipState(); cs.SiafundTaxRevenue != f.pool {
+		return fmt.Errorf("siafund pool is %v, expected %v", cs.SiafundTaxRevenue, f.pool)
+	}
+	return checkClaims(claims, u)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"go.sia.tech/core/consensus"
+	"go.sia.tech/core/types"
+)
+
+// An invalidTxn is a set of transactions the fuzzer built to break a
+// consensus rule. A block containing them must be rejected with an error
+// mentioning one of Errs.
+type invalidTxn struct {
+	Desc   string
+	Errs   []string
+	Txns   []types.Transaction   `json:",omitempty"`
+	V2Txns []types.V2Transaction `json:",omitempty"`
+}
+
+// errorMentions reports whether err mentions any of the substrings in errs.
+func errorMentions(err error, errs []string) bool {
+	for _, s := range errs {
+		if strings.Contains(err.Error(), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRejected validates a block for each invalid transaction generated
+// alongside the next block, checking that the tip rejects it for the
+// expected reason.
+func (f *fuzzer) checkRejected() error {
+	invalid := f.invalid
+	f.invalid = nil
+
+	cs := f.n.tipState()
+	height := cs.Index.Height + 1
+	for _, it := range invalid {
+		b := mineBlock(cs, it.Txns, it.V2Txns, types.VoidAddress)
+		bs := f.n.store.Scratchpad().SupplementTipBlock(b)
+		if height >= cs.Network.HardforkV2.RequireHeight {
+			bs = consensus.V1BlockSupplement{}
+		}
+		if err := consensus.ValidateBlock(cs, b, bs); err == nil {
+			return newInvariantError(invariantReject, height, fmt.Errorf("%s was accepted", it.Desc))
+		} else if !errorMentions(err, it.Errs) {
+			return newInvariantError(invariantReject, height, fmt.Errorf("%s was rejected for the wrong reason: %w", it.Desc, err))
+		}
+	}
+	return nil
+}
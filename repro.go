@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+
+	"go.sia.tech/core/consensus"
+	"go.sia.tech/core/types"
+)
+
+// reproVersion is the current version of the repro file format. Legacy files,
+// which have neither a version nor generation parameters, were always
+// generated with seed 1 and carry no other metadata. Version 2 adds the parts
+// of the fuzzer's model that can't be recovered from the blocks.
+const reproVersion = 2
+
+// dependencyVersions are the versions of the modules under test.
+type dependencyVersions struct {
+	Go        string
+	Core      string
+	Coreutils string
+}
+
+// A failure describes the invariant that a repro violates.
+type failure struct {
+	Invariant string
+	Height    uint64
+	Error     string
+}
+
+// A state is the contents of a repro file: a chain, and everything needed to
+// interpret or regenerate it.
+type state struct {
+	Version  int
+	Versions dependencyVersions
+	Params   fuzzParams
+	DB       dbConfig
+	Failure  *failure // nil if the chain passed
+
+	Genesis types.Block
+	Network *consensus.Network
+
+	Blocks []types.Block
+
+	Locks   []lock         `json:",omitempty"` // every lock the chain's outputs were sent to
+	Invalid [][]invalidTxn `json:",omitempty"` // generated alongside each block
+	Files   [][]byte       `json:",omitempty"` // data of the contracts proved in Blocks
+}
+
+func currentVersions() dependencyVersions {
+	var v dependencyVersions
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	v.Go = info.GoVersion
+	for _, dep := range info.Deps {
+		version := dep.Version
+		if dep.Replace != nil {
+			version = fmt.Sprintf("%s => %s %s", dep.Version, dep.Replace.Path, dep.Replace.Version)
+		}
+		switch dep.Path {
+		case "go.sia.tech/core":
+			v.Core = version
+		case "go.sia.tech/coreutils":
+			v.Coreutils = version
+		}
+	}
+	return v
+}
+
+// newState returns a state for a chain generated with the supplied
+// parameters.
+func newState(p fuzzParams, dbc dbConfig, network *consensus.Network, genesis types.Block) state {
+	return state{
+		Version:  reproVersion,
+		Versions: currentVersions(),
+		Params:   p,
+		DB:       dbc,
+		Genesis:  genesis,
+		Network:  network,
+	}
+}
+
+// record saves the parts of f's model that replaying the chain needs.
+func (s *state) record(f *fuzzer) {
+	s.Locks = mapValues(f.locks)
+	s.Files = provedFiles(s.Blocks, f.proved)
+}
+
+// provedFiles returns the entries of data that the storage proofs in blocks
+// prove. The minimizer needs them to rebuild those proofs; other contracts'
+// data would only bloat the repro file.
+func provedFiles(blocks []types.Block, data map[types.Hash256][]byte) [][]byte {
+	roots := make(map[types.FileContractID]types.Hash256)
+	proved := make(map[types.Hash256][]byte)
+	add := func(root types.Hash256) {
+		if d, ok := data[root]; ok {
+			proved[root] = d
+		}
+	}
+	for _, b := range blocks {
+		for _, txn := range b.Transactions {
+			for i, fc := range txn.FileContracts {
+				roots[txn.FileContractID(i)] = fc.FileMerkleRoot
+			}
+			for _, fcr := range txn.FileContractRevisions {
+				roots[fcr.ParentID] = fcr.FileContract.FileMerkleRoot
+			}
+			for _, sp := range txn.StorageProofs {
+				add(roots[sp.ParentID])
+			}
+		}
+		for _, txn := range b.V2Transactions() {
+			for _, fcr := range txn.FileContractResolutions {
+				if _, ok := fcr.Resolution.(*types.V2StorageProof); ok {
+					add(fcr.Parent.V2FileContract.FileMerkleRoot)
+				}
+			}
+		}
+	}
+	return mapValues(proved)
+}
+
+// restore gives f the parts of the model recorded in s, so that it tracks
+// and can spend the chain's locked outputs and prove its contracts' data.
+func (s *state) restore(f *fuzzer) {
+	for _, l := range s.Locks {
+		f.locks[l.Policy.Address()] = l
+	}
+	for _, data := range s.Files {
+		f.storeFile(data)
+	}
+}
+
+// newFailure returns the failure described by err.
+func newFailure(err error) *failure {
+	var ie *invariantError
+	if !errors.As(err, &ie) {
+		return &failure{Error: err.Error()}
+	}
+	return &failure{
+		Invariant: ie.Invariant,
+		Height:    ie.Height,
+		Error:     ie.Err.Error(),
+	}
+}
+
+// setFailure records err, which may be nil, as the state's failure.
+func (s *state) setFailure(err error) {
+	s.Failure = nil
+	if err != nil {
+		s.Failure = newFailure(err)
+	}
+}
+
+func readState(path string) (state, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return state{}, err
+	}
+	defer file.Close()
+
+	var s state
+	if err := json.NewDecoder(file).Decode(&s); err != nil {
+		return state{}, err
+	}
+
+	switch {
+	case s.Version == 0 && s.Params.Blocks == 0:
+		log.Printf("%s is a legacy repro file; assuming seed 1", path)
+		s.Params.Seed = 1
+		if s.Network != nil {
+			s.Params.AllowHeight = s.Network.HardforkV2.AllowHeight
+			s.Params.RequireHeight = s.Network.HardforkV2.RequireHeight
+		}
+	case s.Version > reproVersion:
+		return state{}, fmt.Errorf("%s has version %d, but this fuzzer only supports up to version %d", path, s.Version, reproVersion)
+	default:
+		cur := currentVersions()
+		if s.Versions.Core != cur.Core {
+			log.Printf("Warning: %s was generated with core %s, running %s", path, s.Versions.Core, cur.Core)
+		}
+		if s.Versions.Coreutils != cur.Coreutils {
+			log.Printf("Warning: %s was generated with coreutils %s, running %s", path, s.Versions.Coreutils, cur.Coreutils)
+		}
+		if s.Failure != nil {
+			log.Printf("%s recorded failure: %s invariant at height %d", path, s.Failure.Invariant, s.Failure.Height)
+		}
+	}
+	if s.Network == nil {
+		return state{}, fmt.Errorf("%s has no network", path)
+	}
+	return s, nil
+}
+
+func writeJSON(path string, v any) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(v); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.sia.tech/core/consensus"
+	"go.sia.tech/core/types"
+)
+
+// expectedSupplement builds the supplement the store should return for b
+// from the fuzzer's tracked elements, which must be those of the tip. Parents
+// created earlier in the block aren't in the store yet, so they're left out.
+func (f *fuzzer) expectedSupplement(b types.Block) consensus.V1BlockSupplement {
+	cs := f.n.tipState()
+	bs := consensus.V1BlockSupplement{
+		Transactions: make([]consensus.V1TransactionSupplement, len(b.Transactions)),
+	}
+	if cs.Index.Height >= cs.Network.HardforkV2.RequireHeight {
+		return bs
+	}
+
+	for i, txn := range b.Transactions {
+		ts := &bs.Transactions[i]
+		for _, sci := range txn.SiacoinInputs {
+			if sce, ok := f.sces[sci.ParentID]; ok && sce.StateElement.LeafIndex != types.UnassignedLeafIndex {
+				ts.SiacoinInputs = append(ts.SiacoinInputs, sce.Copy())
+			}
+		}
+		for _, sfi := range txn.SiafundInputs {
+			if sfe, ok := f.sfes[sfi.ParentID]; ok && sfe.StateElement.LeafIndex != types.UnassignedLeafIndex {
+				ts.SiafundInputs = append(ts.SiafundInputs, sfe.Copy())
+			}
+		}
+		for _, fcr := range txn.FileContractRevisions {
+			if fce, ok := f.fces[fcr.ParentID]; ok && fce.StateElement.LeafIndex != types.UnassignedLeafIndex {
+				ts.RevisedFileContracts = append(ts.RevisedFileContracts, fce.Copy())
+			}
+		}
+		for _, sp := range txn.StorageProofs {
+			fce, ok := f.fces[sp.ParentID]
+			if !ok || fce.StateElement.LeafIndex == types.UnassignedLeafIndex {
+				continue
+			}
+			// the proof window is seeded by the block before it opens
+			if h := fce.FileContract.WindowStart - 1; h < uint64(len(f.cies)) {
+				ts.StorageProofs = append(ts.StorageProofs, consensus.V1StorageProofSupplement{
+					FileContract: fce.Copy(),
+					WindowID:     f.cies[h].ChainIndex.ID,
+				})
+			}
+		}
+	}
+	for _, fce := range mapValues(f.fces) {
+		if fce.FileContract.WindowEnd == cs.Index.Height+1 && fce.StateElement.LeafIndex != types.UnassignedLeafIndex {
+			bs.ExpiringFileContracts = append(bs.ExpiringFileContracts, fce.Copy())
+		}
+	}
+	return bs
+}
+
+// normalizeSupplement returns a canonical copy of bs: every slice is sorted by
+// element ID, and empty slices are nil. Supplements that differ only in
+// order or in how they were decoded normalize to the same value.
+func normalizeSupplement(bs consensus.V1BlockSupplement) consensus.V1BlockSupplement {
+	byID := func(a, b types.Hash256) int { return bytes.Compare(a[:], b[:]) }
+	sorted := func(s []types.FileContractElement) []types.FileContractElement {
+		s = slices.Clone(s)
+		slices.SortFunc(s, func(a, b types.FileContractElement) int { return byID(types.Hash256(a.ID), types.Hash256(b.ID)) })
+		return s
+	}
+
+	var n consensus.V1BlockSupplement
+	for _, ts := range bs.Transactions {
+		ts.SiacoinInputs = slices.Clone(ts.SiacoinInputs)
+		slices.SortFunc(ts.SiacoinInputs, func(a, b types.SiacoinElement) int { return byID(types.Hash256(a.ID), types.Hash256(b.ID)) })
+		ts.SiafundInputs = slices.Clone(ts.SiafundInputs)
+		slices.SortFunc(ts.SiafundInputs, func(a, b types.SiafundElement) int { return byID(types.Hash256(a.ID), types.Hash256(b.ID)) })
+		ts.RevisedFileContracts = sorted(ts.RevisedFileContracts)
+		ts.StorageProofs = slices.Clone(ts.StorageProofs)
+		slices.SortFunc(ts.StorageProofs, func(a, b consensus.V1StorageProofSupplement) int {
+			return byID(types.Hash256(a.FileContract.ID), types.Hash256(b.FileContract.ID))
+		})
+		n.Transactions = append(n.Transactions, consensus.V1TransactionSupplement{
+			SiacoinInputs:        emptyToNil(ts.SiacoinInputs),
+			SiafundInputs:        emptyToNil(ts.SiafundInputs),
+			RevisedFileContracts: emptyToNil(ts.RevisedFileContracts),
+			StorageProofs:        emptyToNil(ts.StorageProofs),
+		})
+	}
+	n.ExpiringFileContracts = emptyToNil(sorted(bs.ExpiringFileContracts))
+	return n
+}
+
+func emptyToNil[T any](s []T) []T {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+}
+
+// supplementsEqual reports whether two supplements normalize to the same
+// value.
+func supplementsEqual(a, b consensus.V1BlockSupplement) bool {
+	return encodingHash(normalizeSupplement(a)) == encodingHash(normalizeSupplement(b))
+}
+
+// A supplementDiffer collects the field-level differences between two
+// normalized supplements.
+type supplementDiffer struct {
+	lines []string
+}
+
+func (d *supplementDiffer) field(prefix, name string, a, b any) {
+	if a != b {
+		d.lines = append(d.lines, fmt.Sprintf("%s: %s %v vs %v", prefix, name, a, b))
+	}
+}
+
+func (d *supplementDiffer) stateElement(prefix string, a, b types.StateElement) {
+	d.field(prefix, "leaf index", a.LeafIndex, b.LeafIndex)
+	if len(a.MerkleProof) != len(b.MerkleProof) {
+		d.field(prefix, "proof length", len(a.MerkleProof), len(b.MerkleProof))
+		return
+	}
+	for i := range a.MerkleProof {
+		if a.MerkleProof[i] != b.MerkleProof[i] {
+			d.field(prefix, fmt.Sprintf("proof hash %d", i), a.MerkleProof[i], b.MerkleProof[i])
+			return
+		}
+	}
+}
+
+func (d *supplementDiffer) outputs(prefix, name string, a, b []types.SiacoinOutput) {
+	if len(a) != len(b) {
+		d.field(prefix, name+" count", len(a), len(b))
+		return
+	}
+	for i := range a {
+		d.field(prefix, fmt.Sprintf("%s %d value", name, i), a[i].Value, b[i].Value)
+		d.field(prefix, fmt.Sprintf("%s %d address", name, i), a[i].Address, b[i].Address)
+	}
+}
+
+func (d *supplementDiffer) fileContract(prefix string, a, b types.FileContractElement) {
+	d.field(prefix, "ID", a.ID, b.ID)
+	d.stateElement(prefix, a.StateElement, b.StateElement)
+	fa, fb := a.FileContract, b.FileContract
+	d.field(prefix, "filesize", fa.Filesize, fb.Filesize)
+	d.field(prefix, "file merkle root", fa.FileMerkleRoot, fb.FileMerkleRoot)
+	d.field(prefix, "window start", fa.WindowStart, fb.WindowStart)
+	d.field(prefix, "window end", fa.WindowEnd, fb.WindowEnd)
+	d.field(prefix, "payout", fa.Payout, fb.Payout)
+	d.field(prefix, "unlock hash", fa.UnlockHash, fb.UnlockHash)
+	d.field(prefix, "revision number", fa.RevisionNumber, fb.RevisionNumber)
+	d.outputs(prefix, "valid proof output", fa.ValidProofOutputs, fb.ValidProofOutputs)
+	d.outputs(prefix, "missed proof output", fa.MissedProofOutputs, fb.MissedProofOutputs)
+}
+
+// compareSlices compares two slices of a supplement, element by element if
+// they have the same length.
+func compareSlices[T any](d *supplementDiffer, prefix, name string, a, b []T, compare func(prefix string, a, b T)) {
+	if len(a) != len(b) {
+		d.field(prefix, name+" count", len(a), len(b))
+		return
+	}
+	for i := range a {
+		compare(fmt.Sprintf("%s %s %d", prefix, name, i), a[i], b[i])
+	}
+}
+
+// diffSupplements returns an error listing every field in which a and b
+// differ once normalized, or nil if they're equal.
+func diffSupplements(a, b consensus.V1BlockSupplement) error {
+	if supplementsEqual(a, b) {
+		return nil
+	}
+	a, b = normalizeSupplement(a), normalizeSupplement(b)
+
+	var d supplementDiffer
+	if len(a.Transactions) != len(b.Transactions) {
+		d.field("supplement", "transaction count", len(a.Transactions), len(b.Transactions))
+	} else {
+		for i := range a.Transactions {
+			ta, tb := a.Transactions[i], b.Transactions[i]
+			prefix := fmt.Sprintf("txn %d", i)
+			compareSlices(&d, prefix, "siacoin input", ta.SiacoinInputs, tb.SiacoinInputs, func(prefix string, a, b types.SiacoinElement) {
+				d.field(prefix, "ID", a.ID, b.ID)
+				d.stateElement(prefix, a.StateElement, b.StateElement)
+				d.field(prefix, "value", a.SiacoinOutput.Value, b.SiacoinOutput.Value)
+				d.field(prefix, "address", a.SiacoinOutput.Address, b.SiacoinOutput.Address)
+				d.field(prefix, "maturity height", a.MaturityHeight, b.MaturityHeight)
+			})
+			compareSlices(&d, prefix, "siafund input", ta.SiafundInputs, tb.SiafundInputs, func(prefix string, a, b types.SiafundElement) {
+				d.field(prefix, "ID", a.ID, b.ID)
+				d.stateElement(prefix, a.StateElement, b.StateElement)
+				d.field(prefix, "value", a.SiafundOutput.Value, b.SiafundOutput.Value)
+				d.field(prefix, "address", a.SiafundOutput.Address, b.SiafundOutput.Address)
+				d.field(prefix, "claim start", a.ClaimStart, b.ClaimStart)
+			})
+			compareSlices(&d, prefix, "revised contract", ta.RevisedFileContracts, tb.RevisedFileContracts, d.fileContract)
+			compareSlices(&d, prefix, "storage proof", ta.StorageProofs, tb.StorageProofs, func(prefix string, a, b consensus.V1StorageProofSupplement) {
+				d.fileContract(prefix, a.FileContract, b.FileContract)
+				d.field(prefix, "window ID", a.WindowID, b.WindowID)
+			})
+		}
+	}
+	compareSlices(&d, "supplement", "expiring contract", a.ExpiringFileContracts, b.ExpiringFileContracts, d.fileContract)
+
+	if len(d.lines) == 0 {
+		// every field we compare matches, so the difference is in one we
+		// don't
+		return errors.New("supplements differ in an uncompared field")
+	}
+	return fmt.Errorf("%d differences:\n\t%s", len(d.lines), strings.Join(d.lines, "\n\t"))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+
+	"go.sia.tech/core/consensus"
+	"go.sia.tech/core/types"
+)
+
+// An update is the set of element diffs shared by ApplyUpdate and
+// RevertUpdate. A revert carries the same diffs as the apply it undoes.
+type update interface {
+	SiacoinElementDiffs() []consensus.SiacoinElementDiff
+	SiafundElementDiffs() []consensus.SiafundElementDiff
+	FileContractElementDiffs() []consensus.FileContractElementDiff
+	V2FileContractElementDiffs() []consensus.V2FileContractElementDiff
+}
+
+// A supplyReport breaks down the siacoins moved by a block.
+type supplyReport struct {
+	Created types.Currency // excluding burns
+	Burned  types.Currency // created to the void
+	Spent   types.Currency
+
+	Issued  types.Currency // block reward and foundation subsidy
+	Payouts types.Currency // resolved contracts, including rollovers
+	Claims  types.Currency
+	Funding types.Currency // new contracts, including tax
+}
+
+func (r supplyReport) String() string {
+	return fmt.Sprintf("created %v, burned %v, spent %v; issued %v, contract payouts %v, siafund claims %v, contract funding %v",
+		r.Created, r.Burned, r.Spent, r.Issued, r.Payouts, r.Claims, r.Funding)
+}
+
+// checkSupply checks that the siacoins created minus those spent by the diffs
+// in u equal the siacoins the block b, applied to parent, should have issued,
+// paid out, and locked up in contracts, less those burned, and that the number
+// of siafunds is unchanged.
+func checkSupply(parent consensus.State, b types.Block, u update) error {
+	var r supplyReport
+	for _, diff := range u.SiacoinElementDiffs() {
+		sco := diff.SiacoinElement.SiacoinOutput
+		if diff.Created && sco.Address == types.VoidAddress {
+			r.Burned = r.Burned.Add(sco.Value)
+		} else if diff.Created {
+			r.Created = r.Created.Add(sco.Value)
+		}
+		if diff.Spent {
+			r.Spent = r.Spent.Add(sco.Value)
+		}
+	}
+
+	r.Issued = parent.BlockReward()
+	if subsidy, ok := parent.FoundationSubsidy(); ok {
+		r.Issued = r.Issued.Add(subsidy.Value)
+	}
+	for _, diff := range u.FileContractElementDiffs() {
+		if !diff.Resolved {
+			continue
+		}
+		fc := diff.FileContractElement.FileContract
+		if diff.Revision != nil {
+			fc = *diff.Revision
+		}
+		outputs := fc.MissedProofOutputs
+		if diff.Valid {
+			outputs = fc.ValidProofOutputs
+		}
+		for _, sco := range outputs {
+			r.Payouts = r.Payouts.Add(sco.Value)
+		}
+	}
+	for _, diff := range u.V2FileContractElementDiffs() {
+		fc := diff.V2FileContractElement.V2FileContract
+		if diff.Revision != nil {
+			fc = *diff.Revision
+		}
+		switch res := diff.Resolution.(type) {
+		case nil:
+		case *types.V2FileContractRenewal:
+			r.Payouts = r.Payouts.Add(res.FinalRenterOutput.Value).Add(res.FinalHostOutput.Value).Add(res.RenterRollover).Add(res.HostRollover)
+		case *types.V2StorageProof:
+			r.Payouts = r.Payouts.Add(fc.RenterOutput.Value).Add(fc.HostOutput.Value)
+		case *types.V2FileContractExpiration:
+			r.Payouts = r.Payouts.Add(fc.RenterOutput.Value).Add(fc.MissedHostOutput().Value)
+		default:
+			return fmt.Errorf("unhandled resolution type %T", res)
+		}
+	}
+	claims, _, err := simulatePool(parent, parent.SiafundTaxRevenue, b, u.SiafundElementDiffs())
+	if err != nil {
+		return err
+	}
+	for _, c := range claims {
+		r.Claims = r.Claims.Add(c)
+	}
+	for _, txn := range b.Transactions {
+		for _, fc := range txn.FileContracts {
+			r.Funding = r.Funding.Add(fc.Payout)
+		}
+	}
+	v2Funding := func(fc types.V2FileContract) types.Currency {
+		return fc.RenterOutput.Value.Add(fc.HostOutput.Value).Add(v2FileContractTax(fc))
+	}
+	for _, txn := range b.V2Transactions() {
+		for _, fc := range txn.FileContracts {
+			r.Funding = r.Funding.Add(v2Funding(fc))
+		}
+		for _, fcr := range txn.FileContractResolutions {
+			if res, ok := fcr.Resolution.(*types.V2FileContractRenewal); ok {
+				r.Funding = r.Funding.Add(v2Funding(res.NewContract))
+			}
+		}
+	}
+
+	// created - spent = issued + payouts + claims - funding - burned,
+	// rearranged to avoid underflow
+	if r.Created.Add(r.Burned).Add(r.Funding) != r.Spent.Add(r.Issued).Add(r.Payouts).Add(r.Claims) {
+		return fmt.Errorf("siacoin supply not conserved: %v", r)
+	}
+
+	var sfCreated, sfSpent uint64
+	for _, diff := range u.SiafundElementDiffs() {
+		if diff.Created {
+			sfCreated += diff.SiafundElement.SiafundOutput.Value
+		}
+		if diff.Spent {
+			sfSpent += diff.SiafundElement.SiafundOutput.Value
+		}
+	}
+	if sfCreated != sfSpent {
+		return fmt.Errorf("siafund count changed: created %d, spent %d", sfCreated, sfSpent)
+	}
+	return nil
+}
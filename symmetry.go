@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"go.sia.tech/core/consensus"
+	"go.sia.tech/core/types"
+)
+
+// A diffSummary is the part of an element diff that the diff reverting it
+// must mirror.
+type diffSummary struct {
+	ID         types.Hash256
+	Element    types.Hash256 // excluding the state element
+	LeafIndex  uint64
+	Created    bool
+	Spent      bool
+	Revision   types.Hash256 // zero if not revised
+	Resolution string        // empty if not resolved
+}
+
+func encodingHash(v types.EncoderTo) types.Hash256 {
+	h := types.NewHasher()
+	v.EncodeTo(h.E)
+	return h.Sum()
+}
+
+func summarizeSiacoinDiffs(diffs []consensus.SiacoinElementDiff) []diffSummary {
+	s := make([]diffSummary, len(diffs))
+	for i, d := range diffs {
+		s[i] = diffSummary{
+			ID:        types.Hash256(d.SiacoinElement.ID),
+			Element:   siacoinElementHash(d.SiacoinElement),
+			LeafIndex: d.SiacoinElement.StateElement.LeafIndex,
+			Created:   d.Created,
+			Spent:     d.Spent,
+		}
+	}
+	return s
+}
+
+func summarizeSiafundDiffs(diffs []consensus.SiafundElementDiff) []diffSummary {
+	s := make([]diffSummary, len(diffs))
+	for i, d := range diffs {
+		s[i] = diffSummary{
+			ID:        types.Hash256(d.SiafundElement.ID),
+			Element:   siafundElementHash(d.SiafundElement),
+			LeafIndex: d.SiafundElement.StateElement.LeafIndex,
+			Created:   d.Created,
+			Spent:     d.Spent,
+		}
+	}
+	return s
+}
+
+func summarizeFileContractDiffs(diffs []consensus.FileContractElementDiff) []diffSummary {
+	s := make([]diffSummary, len(diffs))
+	for i, d := range diffs {
+		s[i] = diffSummary{
+			ID:        types.Hash256(d.FileContractElement.ID),
+			Element:   fileContractElementHash(d.FileContractElement),
+			LeafIndex: d.FileContractElement.StateElement.LeafIndex,
+			Created:   d.Created,
+		}
+		if d.Revision != nil {
+			s[i].Revision = encodingHash(*d.Revision)
+		}
+		if d.Resolved && d.Valid {
+			s[i].Resolution = "valid"
+		} else if d.Resolved {
+			s[i].Resolution = "missed"
+		}
+	}
+	return s
+}
+
+func summarizeV2FileContractDiffs(diffs []consensus.V2FileContractElementDiff) []diffSummary {
+	s := make([]diffSummary, len(diffs))
+	for i, d := range diffs {
+		s[i] = diffSummary{
+			ID:        types.Hash256(d.V2FileContractElement.ID),
+			Element:   v2FileContractElementHash(d.V2FileContractElement),
+			LeafIndex: d.V2FileContractElement.StateElement.LeafIndex,
+			Created:   d.Created,
+		}
+		if d.Revision != nil {
+			s[i].Revision = encodingHash(*d.Revision)
+		}
+		switch r := d.Resolution.(type) {
+		case nil:
+		case *types.V2FileContractRenewal:
+			s[i].Resolution = fmt.Sprintf("renewal %v", encodingHash(r))
+		case *types.V2StorageProof:
+			s[i].Resolution = fmt.Sprintf("storage proof %v", encodingHash(r))
+		case *types.V2FileContractExpiration:
+			s[i].Resolution = "expiration"
+		default:
+			s[i].Resolution = fmt.Sprintf("%T", r)
+		}
+	}
+	return s
+}
+
+// An asymmetry is a difference between an applied diff and the diff that
+// reverts it.
+type asymmetry struct {
+	Kind   string
+	ID     types.Hash256
+	Field  string
+	Apply  any
+	Revert any
+}
+
+// An asymmetryReport lists every asymmetry between the diffs of an
+// ApplyUpdate and those of the RevertUpdate that undoes it.
+type asymmetryReport []asymmetry
+
+func (r asymmetryReport) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d asymmetries between apply and revert diffs:", len(r))
+	for _, a := range r {
+		fmt.Fprintf(&sb, "\n\t%s %v: %s is %v on apply, %v on revert", a.Kind, a.ID, a.Field, a.Apply, a.Revert)
+	}
+	return sb.String()
+}
+
+// compareDiffs compares the summaries of one kind of element diff. The revert
+// diffs must contain the same elements as the apply diffs, in reverse order.
+func compareDiffs(kind string, apply, revert []diffSummary) (r asymmetryReport) {
+	reverted := make(map[types.Hash256]diffSummary)
+	for _, d := range revert {
+		reverted[d.ID] = d
+	}
+	applied := make(map[types.Hash256]bool)
+	for _, a := range apply {
+		applied[a.ID] = true
+		d, ok := reverted[a.ID]
+		if !ok {
+			r = append(r, asymmetry{kind, a.ID, "presence", true, false})
+			continue
+		}
+		check := func(field string, x, y any) {
+			if x != y {
+				r = append(r, asymmetry{kind, a.ID, field, x, y})
+			}
+		}
+		check("element", a.Element, d.Element)
+		check("created", a.Created, d.Created)
+		check("spent", a.Spent, d.Spent)
+		check("revision", a.Revision, d.Revision)
+		check("resolution", a.Resolution, d.Resolution)
+		// elements created by the block are removed from the accumulator
+		// on revert, so only existing elements keep their leaf
+		if !a.Created {
+			check("leaf index", a.LeafIndex, d.LeafIndex)
+		}
+	}
+	for _, d := range revert {
+		if !applied[d.ID] {
+			r = append(r, asymmetry{kind, d.ID, "presence", false, true})
+		}
+	}
+	if len(r) == 0 {
+		for i := range apply {
+			if j := len(revert) - 1 - i; apply[i].ID != revert[j].ID {
+				r = append(r, asymmetry{kind, apply[i].ID, "position", i, j})
+			}
+		}
+	}
+	return r
+}
+
+// checkSymmetry checks that ru is the exact inverse of au.
+func checkSymmetry(au consensus.ApplyUpdate, ru consensus.RevertUpdate) error {
+	var r asymmetryReport
+	r = append(r, compareDiffs("siacoin element", summarizeSiacoinDiffs(au.SiacoinElementDiffs()), summarizeSiacoinDiffs(ru.SiacoinElementDiffs()))...)
+	r = append(r, compareDiffs("siafund element", summarizeSiafundDiffs(au.SiafundElementDiffs()), summarizeSiafundDiffs(ru.SiafundElementDiffs()))...)
+	r = append(r, compareDiffs("file contract", summarizeFileContractDiffs(au.FileContractElementDiffs()), summarizeFileContractDiffs(ru.FileContractElementDiffs()))...)
+	r = append(r, compareDiffs("v2 file contract", summarizeV2FileContractDiffs(au.V2FileContractElementDiffs()), summarizeV2FileContractDiffs(ru.V2FileContractElementDiffs()))...)
+
+	acie, rcie := au.ChainIndexElement(), ru.ChainIndexElement()
+	if acie.ID != rcie.ID {
+		r = append(r, asymmetry{"chain index element", types.Hash256(acie.ID), "ID", acie.ID, rcie.ID})
+	} else if acie.ChainIndex != rcie.ChainIndex {
+		r = append(r, asymmetry{"chain index element", types.Hash256(acie.ID), "index", acie.ChainIndex, rcie.ChainIndex})
+	}
+	if len(r) > 0 {
+		return r
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"go.sia.tech/core/types"
+)
+
+var (
+	hexRegexp   = regexp.MustCompile(`[0-9a-f]{8,}`)
+	digitRegexp = regexp.MustCompile(`[0-9]+`)
+)
+
+// normalizeError strips the IDs and numbers from the first line of an error
+// message, which change whenever a chain is rebuilt. Panics carry their stack
+// on the following lines.
+func normalizeError(msg string) string {
+	msg, _, _ = strings.Cut(msg, "\n")
+	msg = hexRegexp.ReplaceAllString(msg, "<id>")
+	return digitRegexp.ReplaceAllString(msg, "<n>")
+}
+
+// stackTop returns the function that panicked, given the stack of a panic
+// failure. Frames in core and coreutils are preferred over the fuzzer's own.
+func stackTop(msg string) string {
+	_, stack, ok := strings.Cut(msg, "\n")
+	if !ok {
+		return ""
+	}
+	var funcs []string
+	panicked := false
+	for line := range strings.SplitSeq(stack, "\n") {
+		if line == "" || strings.HasPrefix(line, "\t") {
+			continue // file and line
+		} else if strings.HasPrefix(line, "panic(") {
+			panicked = true
+			continue
+		} else if panicked {
+			if i := strings.LastIndex(line, "("); i > 0 {
+				line = line[:i] // arguments
+			}
+			funcs = append(funcs, line)
+		}
+	}
+	for _, fn := range funcs {
+		if strings.HasPrefix(fn, "go.sia.tech/core/") || strings.HasPrefix(fn, "go.sia.tech/coreutils/") {
+			return fn
+		}
+	}
+	if len(funcs) > 0 {
+		return funcs[0]
+	}
+	return ""
+}
+
+// A signature identifies a bug. Failures with the same signature are assumed
+// to have the same cause.
+type signature struct {
+	Invariant string
+	Error     string
+	Frame     string `json:",omitempty"` // for panics
+}
+
+// ID returns a short, filesystem-safe identifier for the signature.
+func (sig signature) ID() string {
+	h := types.HashBytes([]byte(sig.Invariant + "\n" + sig.Error + "\n" + sig.Frame))
+	return sig.Invariant + "-" + hex.EncodeToString(h[:4])
+}
+
+func (f *failure) signature() signature {
+	sig := signature{
+		Invariant: f.Invariant,
+		Error:     normalizeError(f.Error),
+	}
+	if f.Invariant == invariantPanic {
+		sig.Frame = stackTop(f.Error)
+	}
+	return sig
+}
+
+// A bucket collects the failures that share a signature. Only the smallest
+// repro is kept.
+type bucket struct {
+	Signature    signature
+	Count        int
+	Seeds        []int64
+	Blocks       int // size of the kept repro
+	Transactions int
+}
+
+func chainSize(blocks []types.Block) (txns int) {
+	for _, b := range blocks {
+		txns += len(b.Transactions) + len(b.V2Transactions())
+	}
+	return
+}
+
+func readBucket(dir string) (bucket, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, "bucket.json"))
+	if err != nil {
+		return bucket{}, err
+	}
+	var b bucket
+	err = json.Unmarshal(buf, &b)
+	return b, err
+}
+
+// addToBucket files the failing state s in the corpus directory, returning
+// the path of its bucket.
+func addToBucket(corpus string, s state) (string, error) {
+	if s.Failure == nil {
+		return "", errors.New("state has no failure")
+	}
+	sig := s.Failure.signature()
+	dir := filepath.Join(corpus, sig.ID())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	b, err := readBucket(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		b = bucket{Signature: sig}
+	} else if err != nil {
+		return "", err
+	}
+	b.Count++
+	b.Seeds = append(b.Seeds, s.Params.Seed)
+
+	txns := chainSize(s.Blocks)
+	if b.Count == 1 || len(s.Blocks) < b.Blocks || (len(s.Blocks) == b.Blocks && txns < b.Transactions) {
+		if err := writeJSON(filepath.Join(dir, "repro.json"), s); err != nil {
+			return "", err
+		}
+		b.Blocks, b.Transactions = len(s.Blocks), txns
+	}
+	return dir, writeJSON(filepath.Join(dir, "bucket.json"), b)
+}
+
+func triageCommand(corpus string) error {
+	entries, err := os.ReadDir(corpus)
+	if err != nil {
+		return err
+	}
+	var buckets []bucket
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		b, err := readBucket(filepath.Join(corpus, e.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to read bucket %s: %w", e.Name(), err)
+		}
+		buckets = append(buckets, b)
+	}
+	slices.SortFunc(buckets, func(a, b bucket) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Signature.ID(), b.Signature.ID()))
+	})
+
+	if len(buckets) == 0 {
+		fmt.Println("No failures in", corpus)
+		return nil
+	}
+	for _, b := range buckets {
+		fmt.Printf("%s: %d failures, smallest repro %d blocks, %d transactions (%s)\n", b.Signature.ID(), b.Count, b.Blocks, b.Transactions, filepath.Join(corpus, b.Signature.ID(), "repro.json"))
+		fmt.Printf("    %s\n", b.Signature.Error)
+		if b.Signature.Frame != "" {
+			fmt.Printf("    at %s\n", b.Signature.Frame)
+		}
+	}
+	return nil
+}
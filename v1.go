@@ -2,30 +2,149 @@ package main
 
 import (
 	"crypto/ed25519"
+	"fmt"
+	"slices"
 
 	proto2 "go.sia.tech/core/rhp/v2"
 	"go.sia.tech/core/types"
 )
 
-func (f *fuzzer) prepareContract(endHeight uint64) types.FileContract {
+func (f *fuzzer) prepareContract() types.FileContract {
 	seed := make([]byte, ed25519.SeedSize)
-	f.rng.Read(seed)
+	f.fillRandom(seed)
 	pk := types.NewPrivateKeyFromSeed(seed)
 	publicKey := pk.PublicKey()
 
+	// give each contract its own window end, so that most expire alone and
+	// can be proved without tripping reordersExpirations
+	endHeight := f.n.tip().Height + 10 + uint64(f.rng.Intn(10))
 	hs := proto2.HostSettings{
-		WindowSize: 1,
+		WindowSize: f.freeWindowEnd(endHeight+1+uint64(f.rng.Intn(10))) - endHeight,
 		Address:    types.StandardUnlockHash(publicKey),
 	}
 	sc := types.Siacoins(1)
 	fc := proto2.PrepareContractFormation(publicKey, publicKey, sc.Mul64(2), sc.Mul64(2), endHeight, hs, hs.Address)
-	fc.UnlockHash = f.addr
+	fc.UnlockHash = f.randomActor().addr
+	fc.Filesize, fc.FileMerkleRoot = f.storeFile(f.randomData(16))
 	return fc
 }
 
+// freeWindowEnd returns the first height at or after end at which no v1
+// contract's window ends, and reserves it for the rest of the block. With
+// -knownBugs, it returns end, so that contracts share window ends and
+// resolving them trips the bug reordersExpirations avoids.
+func (f *fuzzer) freeWindowEnd(end uint64) uint64 {
+	if f.knownBugs {
+		return end
+	}
+	sp := f.n.store.Scratchpad()
+	for f.windowEnds[end] || len(sp.ExpiringFileContractIDs(end)) > 0 {
+		end++
+	}
+	f.windowEnds[end] = true
+	return end
+}
+
+// reordersExpirations reports whether resolving fce, or moving its window, in
+// the next block would trip a known coreutils bug: reverting the block puts
+// the contract back at the front of the contracts expiring with it instead of
+// where it was, which changes the leaves of their missed proof outputs.
+// Contracts formed in the block and contracts that expire alone are
+// unaffected. With -knownBugs, the fuzzer trips it anyway.
+func (f *fuzzer) reordersExpirations(fce types.FileContractElement) bool {
+	if f.knownBugs || fce.StateElement.LeafIndex == types.UnassignedLeafIndex {
+		return false
+	}
+	ids := f.n.store.Scratchpad().ExpiringFileContractIDs(fce.FileContract.WindowEnd)
+	return len(ids) != 1 || ids[0] != fce.ID
+}
+
+// storageProof returns a proof of the segment of fce's data that the window
+// start block selects.
+func (f *fuzzer) storageProof(fce types.FileContractElement) types.StorageProof {
+	fc := fce.FileContract
+	data := f.files[fc.FileMerkleRoot]
+	f.proved[fc.FileMerkleRoot] = data
+	windowID := f.cies[fc.WindowStart-1].ChainIndex.ID
+	i := f.n.tipState().StorageProofLeafIndex(fc.Filesize, windowID, fce.ID)
+
+	sp := types.StorageProof{ParentID: fce.ID}
+	if fc.Filesize > 0 {
+		copy(sp.Leaf[:], segment(data, i))
+		sp.Proof = fileMerkleProof(data, i)
+	}
+	return sp
+}
+
+// shiftPayout returns a copy of outputs with a random part of the renter's
+// payout moved to the host or vice versa. The total is unchanged.
+func (f *fuzzer) shiftPayout(outputs []types.SiacoinOutput) []types.SiacoinOutput {
+	outputs = slices.Clone(outputs)
+	from, to := 0, 1
+	if f.rng.Intn(2) == 0 {
+		from, to = to, from
+	}
+	amount := outputs[from].Value.Div64(uint64(1 + f.rng.Intn(4)))
+	outputs[from].Value = outputs[from].Value.Sub(amount)
+	outputs[to].Value = outputs[to].Value.Add(amount)
+	return outputs
+}
+
+// generateInvalidRevisions queues revisions of contracts in the tip state
+// that break the revision rules. Each must be rejected.
+func (f *fuzzer) generateInvalidRevisions() {
+	height := f.n.tip().Height
+	count := f.rng.Intn(3)
+	for _, fce := range mapValues(f.fces) {
+		if count == 0 {
+			break
+		}
+		owner, ok := f.owner(fce.FileContract.UnlockHash)
+		if !ok || fce.StateElement.LeafIndex == types.UnassignedLeafIndex {
+			continue
+		}
+
+		fc := fce.FileContract
+		fc.RevisionNumber++
+		var desc, reason string
+		switch {
+		case fc.WindowStart < height+1:
+			// the revision itself is fine, but it comes too late
+			fc.WindowStart = height + 2
+			fc.WindowEnd = fc.WindowStart + 1
+			desc, reason = "after its proof window opened", "after its proof window has opened"
+		case f.rng.Intn(3) == 0:
+			fc.ValidProofOutputs = slices.Clone(fc.ValidProofOutputs)
+			fc.ValidProofOutputs[1].Value = fc.ValidProofOutputs[1].Value.Add(types.NewCurrency64(1))
+			desc, reason = "that changes its valid payout sum", "changes valid payout sum"
+		case f.rng.Intn(2) == 0:
+			fc.MissedProofOutputs = slices.Clone(fc.MissedProofOutputs)
+			fc.MissedProofOutputs[0].Value = fc.MissedProofOutputs[0].Value.Add(types.NewCurrency64(1))
+			desc, reason = "that changes its missed payout sum", "changes missed payout sum"
+		default:
+			fc.RevisionNumber -= 1 + uint64(f.rng.Intn(int(min(fc.RevisionNumber, 3))))
+			desc, reason = "without a higher revision number", "does not have a higher revision number"
+		}
+		txn := types.Transaction{
+			FileContractRevisions: []types.FileContractRevision{{
+				ParentID:         fce.ID,
+				UnlockConditions: owner.uc,
+				FileContract:     fc,
+			}},
+		}
+		signTransaction(f.n.tipState(), f.keys, &txn)
+		f.invalid = append(f.invalid, invalidTxn{
+			Desc: fmt.Sprintf("revision of v1 contract %v %s", fce.ID, desc),
+			Errs: []string{reason},
+			Txns: []types.Transaction{txn},
+		})
+		count--
+	}
+}
+
 func (f *fuzzer) generateTransaction() (txn types.Transaction) {
 	{
-		count := f.rng.Intn(1)
+		count := f.rng.Intn(3)
 		for _, fce := range mapValues(f.fces) {
 			if len(txn.StorageProofs) >= count {
 				break
@@ -34,12 +153,10 @@ func (f *fuzzer) generateTransaction() (txn types.Transaction) {
 			id := fce.ID
 			fc := fce.FileContract
 			height := f.n.tip().Height
-			if height < fc.WindowStart {
+			if height+1 < fc.WindowStart || f.reordersExpirations(fce) {
 				continue
 			}
-			txn.StorageProofs = append(txn.StorageProofs, types.StorageProof{
-				ParentID: id,
-			})
+			txn.StorageProofs = append(txn.StorageProofs, f.storageProof(fce))
 			delete(f.fces, id)
 		}
 		if len(txn.StorageProofs) > 0 {
@@ -50,7 +167,7 @@ func (f *fuzzer) generateTransaction() (txn types.Transaction) {
 	var amount types.Currency
 	{
 		for i, count := 0, f.rng.Intn(10); i < count; i++ {
-			fc := f.prepareContract(f.n.tip().Height + 10)
+			fc := f.prepareContract()
 			txn.FileContracts = append(txn.FileContracts, fc)
 			amount = amount.Add(fc.Payout)
 		}
@@ -65,15 +182,31 @@ func (f *fuzzer) generateTransaction() (txn types.Transaction) {
 
 			fc := fce.FileContract
 			height := f.n.tip().Height
-			if fc.WindowStart >= height {
+			if fc.WindowStart <= height+1 {
+				// revisions must come before the window opens
+				continue
+			}
+			owner, ok := f.owner(fc.UnlockHash)
+			if !ok {
 				continue
 			}
-			fc.RevisionNumber++
-			// fc.WindowStart = height + 1
-			// fc.WindowEnd = fc.WindowStart + 10
+			fc.RevisionNumber += 1 + uint64(f.rng.Intn(3))
+			if f.rng.Intn(2) == 0 {
+				fc.Filesize, fc.FileMerkleRoot = f.storeFile(append(slices.Clone(f.files[fc.FileMerkleRoot]), f.randomData(4)...))
+			}
+			if f.rng.Intn(2) == 0 {
+				fc.ValidProofOutputs = f.shiftPayout(fc.ValidProofOutputs)
+				fc.MissedProofOutputs = f.shiftPayout(fc.MissedProofOutputs)
+			}
+			if !f.reordersExpirations(fce) && f.rng.Intn(2) == 0 {
+				// the window may move earlier or later, but can't open in
+				// the block that contains the revision
+				fc.WindowStart = height + 2 + uint64(f.rng.Intn(10))
+				fc.WindowEnd = f.freeWindowEnd(fc.WindowStart + 1 + uint64(f.rng.Intn(10)))
+			}
 			txn.FileContractRevisions = append(txn.FileContractRevisions, types.FileContractRevision{
 				ParentID:         fce.ID,
-				UnlockConditions: f.uc,
+				UnlockConditions: owner.uc,
 				FileContract:     fc,
 			})
 			f.fces[fce.ID] = types.FileContractElement{
@@ -88,7 +221,7 @@ func (f *fuzzer) generateTransaction() (txn types.Transaction) {
 	{
 		for i, count := 0, f.rng.Intn(3); i < count; i++ {
 			sco := types.SiacoinOutput{
-				Address: f.addr,
+				Address: f.randomActor().addr,
 				Value:   types.NewCurrency64(1),
 			}
 
@@ -97,12 +230,21 @@ func (f *fuzzer) generateTransaction() (txn types.Transaction) {
 		}
 		if amount.Cmp(types.ZeroCurrency) == 1 {
 			var sum types.Currency
-			for _, sce := range mapValues(f.sces) {
+			var change types.Address
+			sces := fundingOrder(mapValues(f.sces), f.funders(), func(sce types.SiacoinElement) types.Address { return sce.SiacoinOutput.Address })
+			for _, sce := range sces {
 				id := sce.ID
+				owner, ok := f.owner(sce.SiacoinOutput.Address)
+				if !ok {
+					// v1 inputs can only be spent with unlock conditions
+					continue
+				} else if len(txn.SiacoinInputs) == 0 {
+					change = owner.addr
+				}
 				sum = sum.Add(sce.SiacoinOutput.Value)
 				txn.SiacoinInputs = append(txn.SiacoinInputs, types.SiacoinInput{
 					ParentID:         id,
-					UnlockConditions: f.uc,
+					UnlockConditions: owner.uc,
 				})
 				delete(f.sces, id)
 
@@ -112,7 +254,7 @@ func (f *fuzzer) generateTransaction() (txn types.Transaction) {
 			}
 			if sum.Cmp(amount) == 1 {
 				txn.SiacoinOutputs = append(txn.SiacoinOutputs, types.SiacoinOutput{
-					Address: f.addr,
+					Address: change,
 					Value:   sum.Sub(amount),
 				})
 			}
@@ -122,7 +264,7 @@ func (f *fuzzer) generateTransaction() (txn types.Transaction) {
 		var amount uint64
 		for i, count := 0, f.rng.Intn(3); i < count; i++ {
 			sfo := types.SiafundOutput{
-				Address: f.addr,
+				Address: f.randomActor().addr,
 				Value:   1,
 			}
 
@@ -131,12 +273,18 @@ func (f *fuzzer) generateTransaction() (txn types.Transaction) {
 		}
 		if amount > 0 {
 			var sum uint64
-			for _, sfe := range mapValues(f.sfes) {
+			var change types.Address
+			sfes := fundingOrder(mapValues(f.sfes), f.funders(), func(sfe types.SiafundElement) types.Address { return sfe.SiafundOutput.Address })
+			for _, sfe := range sfes {
 				id := sfe.ID
+				owner, _ := f.owner(sfe.SiafundOutput.Address)
+				if len(txn.SiafundInputs) == 0 {
+					change = owner.addr
+				}
 				sum += sfe.SiafundOutput.Value
 				txn.SiafundInputs = append(txn.SiafundInputs, types.SiafundInput{
 					ParentID:         id,
-					UnlockConditions: f.uc,
+					UnlockConditions: owner.uc,
 				})
 				delete(f.sfes, id)
 
@@ -146,13 +294,13 @@ func (f *fuzzer) generateTransaction() (txn types.Transaction) {
 			}
 			if sum > amount {
 				txn.SiafundOutputs = append(txn.SiafundOutputs, types.SiafundOutput{
-					Address: f.addr,
+					Address: change,
 					Value:   sum - amount,
 				})
 			}
 		}
 	}
-	signTransaction(f.n.tipState(), f.pk, &txn)
+	signTransaction(f.n.tipState(), f.keys, &txn)
 
 	for i, sco := range txn.SiacoinOutputs {
 		id := txn.SiacoinOutputID(i)
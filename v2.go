@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"slices"
 	"sort"
 
 	"go.sia.tech/core/consensus"
@@ -28,11 +30,60 @@ func prepareV2Contract(renterPK, hostPK types.PrivateKey, proofHeight uint64) (t
 	return fc, payoutV2(fc)
 }
 
+// v2StorageProof returns a proof of the segment of fce's data that the block
+// at its proof height selects.
+func (f *fuzzer) v2StorageProof(fce types.V2FileContractElement) *types.V2StorageProof {
+	fc := fce.V2FileContract
+	sp := &types.V2StorageProof{ProofIndex: f.cies[fc.ProofHeight].Copy()}
+	if fc.Filesize > 0 {
+		data := f.files[fc.FileMerkleRoot]
+		f.proved[fc.FileMerkleRoot] = data
+		i := f.n.tipState().StorageProofLeafIndex(fc.Filesize, sp.ProofIndex.ChainIndex.ID, fce.ID)
+		copy(sp.Leaf[:], segment(data, i))
+		sp.Proof = fileMerkleProof(data, i)
+	}
+	return sp
+}
+
+// generateInvalidV2Proofs queues storage proofs for fce that prove the wrong
+// segment or a tampered one. Each must be rejected.
+func (f *fuzzer) generateInvalidV2Proofs(fce types.V2FileContractElement) {
+	fc := fce.V2FileContract
+	if fc.Filesize == 0 {
+		return
+	}
+	queue := func(desc string, sp *types.V2StorageProof) {
+		f.invalid = append(f.invalid, invalidTxn{
+			Desc: fmt.Sprintf("storage proof for contract %v with %s", fce.ID, desc),
+			Errs: []string{"root that does not match contract Merkle root"},
+			V2Txns: []types.V2Transaction{{
+				FileContractResolutions: []types.V2FileContractResolution{{
+					Parent:     fce.Copy(),
+					Resolution: sp,
+				}},
+			}},
+		})
+	}
+
+	data := f.files[fc.FileMerkleRoot]
+	valid := f.v2StorageProof(fce)
+	if n := fc.Filesize / segmentSize; n > 1 {
+		i := f.n.tipState().StorageProofLeafIndex(fc.Filesize, valid.ProofIndex.ChainIndex.ID, fce.ID)
+		j := (i + 1 + uint64(f.rng.Intn(int(n-1)))) % n
+		sp := &types.V2StorageProof{ProofIndex: valid.ProofIndex.Copy(), Proof: fileMerkleProof(data, j)}
+		copy(sp.Leaf[:], segment(data, j))
+		queue(fmt.Sprintf("segment %d instead of %d", j, i), sp)
+	}
+	sp := &types.V2StorageProof{ProofIndex: valid.ProofIndex.Copy(), Leaf: valid.Leaf, Proof: valid.Proof}
+	sp.Leaf[f.rng.Intn(len(sp.Leaf))] ^= 1 << f.rng.Intn(8)
+	queue("a tampered leaf", sp)
+}
+
 type hash256Like interface {
 	~[32]byte
 }
 
-func mapValues[K hash256Like, V any](m map[K]V) []V {
+func mapKeys[K hash256Like, V any](m map[K]V) []K {
 	keys := make([]K, 0, len(m))
 	for k := range m {
 		keys = append(keys, k)
@@ -41,9 +92,12 @@ func mapValues[K hash256Like, V any](m map[K]V) []V {
 	sort.Slice(keys, func(i, j int) bool {
 		return bytes.Compare(keys[i][:], keys[j][:]) < 0
 	})
+	return keys
+}
 
+func mapValues[K hash256Like, V any](m map[K]V) []V {
 	values := make([]V, 0, len(m))
-	for _, k := range keys {
+	for _, k := range mapKeys(m) {
 		values = append(values, m[k])
 	}
 	return values
@@ -53,7 +107,9 @@ func (f *fuzzer) generateV2Transaction(originalParents map[types.FileContractID]
 	var amount types.Currency
 	{
 		for i, count := 0, f.rng.Intn(10); i < count; i++ {
-			fc, payout := prepareV2Contract(f.pk, f.pk, f.n.tip().Height+1)
+			fc, payout := prepareV2Contract(f.randomActor().pk, f.randomActor().pk, f.n.tip().Height+1+uint64(f.rng.Intn(10)))
+			fc.Filesize, fc.FileMerkleRoot = f.storeFile(f.randomSectors(4))
+			fc.Capacity = fc.Filesize
 
 			amount = amount.Add(payout)
 			txn.FileContracts = append(txn.FileContracts, fc)
@@ -74,6 +130,10 @@ func (f *fuzzer) generateV2Transaction(originalParents map[types.FileContractID]
 				continue
 			}
 			fc.RevisionNumber++
+			if f.rng.Intn(2) == 0 {
+				fc.Filesize, fc.FileMerkleRoot = f.storeFile(append(slices.Clone(f.files[fc.FileMerkleRoot]), f.randomSectors(3)...))
+				fc.Capacity = max(fc.Capacity, fc.Filesize)
+			}
 
 			parent := fce.Copy()
 			if v, ok := originalParents[id]; ok {
@@ -120,11 +180,12 @@ func (f *fuzzer) generateV2Transaction(originalParents map[types.FileContractID]
 			}
 
 			txn.FileContractResolutions = append(txn.FileContractResolutions, types.V2FileContractResolution{
-				Parent: parent,
-				Resolution: &types.V2StorageProof{
-					ProofIndex: f.cies[fc.ProofHeight].Copy(),
-				},
+				Parent:     parent,
+				Resolution: f.v2StorageProof(parent),
 			})
+			if f.rng.Intn(4) == 0 {
+				f.generateInvalidV2Proofs(parent)
+			}
 			delete(f.v2fces, id)
 
 			i++
@@ -208,7 +269,7 @@ func (f *fuzzer) generateV2Transaction(originalParents map[types.FileContractID]
 	{
 		for i, count := 0, f.rng.Intn(3); i < count; i++ {
 			sco := types.SiacoinOutput{
-				Address: f.addr,
+				Address: f.v2OutputAddress(),
 				Value:   types.NewCurrency64(1),
 			}
 
@@ -217,11 +278,20 @@ func (f *fuzzer) generateV2Transaction(originalParents map[types.FileContractID]
 		}
 		if amount.Cmp(types.ZeroCurrency) == 1 {
 			var sum types.Currency
-			for _, sce := range mapValues(f.sces) {
+			var change types.Address
+			sces := fundingOrder(mapValues(f.sces), f.funders(), func(sce types.SiacoinElement) types.Address { return sce.SiacoinOutput.Address })
+			for _, sce := range sces {
+				sp, ok := f.spendPolicy(sce.SiacoinOutput.Address)
+				if !ok {
+					continue
+				} else if _, ok := f.owner(sce.SiacoinOutput.Address); ok && change == (types.Address{}) {
+					// keep change spendable by v1 transactions
+					change = sce.SiacoinOutput.Address
+				}
 				sum = sum.Add(sce.SiacoinOutput.Value)
 				txn.SiacoinInputs = append(txn.SiacoinInputs, types.V2SiacoinInput{
 					Parent:          sce,
-					SatisfiedPolicy: types.SatisfiedPolicy{Policy: f.policy},
+					SatisfiedPolicy: sp,
 				})
 				delete(f.sces, sce.ID)
 
@@ -229,9 +299,12 @@ func (f *fuzzer) generateV2Transaction(originalParents map[types.FileContractID]
 					break
 				}
 			}
+			if change == (types.Address{}) {
+				change = f.randomActor().addr
+			}
 			if sum.Cmp(amount) == 1 {
 				txn.SiacoinOutputs = append(txn.SiacoinOutputs, types.SiacoinOutput{
-					Address: f.addr,
+					Address: change,
 					Value:   sum.Sub(amount),
 				})
 			}
@@ -241,7 +314,7 @@ func (f *fuzzer) generateV2Transaction(originalParents map[types.FileContractID]
 		var amount uint64
 		for i, count := 0, f.rng.Intn(3); i < count; i++ {
 			sfo := types.SiafundOutput{
-				Address: f.addr,
+				Address: f.randomActor().addr,
 				Value:   1,
 			}
 
@@ -250,11 +323,17 @@ func (f *fuzzer) generateV2Transaction(originalParents map[types.FileContractID]
 		}
 		if amount > 0 {
 			var sum uint64
-			for _, sfe := range mapValues(f.sfes) {
+			var change types.Address
+			sfes := fundingOrder(mapValues(f.sfes), f.funders(), func(sfe types.SiafundElement) types.Address { return sfe.SiafundOutput.Address })
+			for _, sfe := range sfes {
+				owner, _ := f.owner(sfe.SiafundOutput.Address)
+				if len(txn.SiafundInputs) == 0 {
+					change = owner.addr
+				}
 				sum += sfe.SiafundOutput.Value
 				txn.SiafundInputs = append(txn.SiafundInputs, types.V2SiafundInput{
 					Parent:          sfe,
-					SatisfiedPolicy: types.SatisfiedPolicy{Policy: f.policy},
+					SatisfiedPolicy: types.SatisfiedPolicy{Policy: owner.policy},
 				})
 				delete(f.sfes, sfe.ID)
 
@@ -264,7 +343,7 @@ func (f *fuzzer) generateV2Transaction(originalParents map[types.FileContractID]
 			}
 			if sum > amount {
 				txn.SiafundOutputs = append(txn.SiafundOutputs, types.SiafundOutput{
-					Address: f.addr,
+					Address: change,
 					Value:   sum - amount,
 				})
 			}
@@ -273,11 +352,11 @@ func (f *fuzzer) generateV2Transaction(originalParents map[types.FileContractID]
 	// so we don't get "transactions cannot be empty"
 	txn.ArbitraryData = []byte("1234")
 	txn.Attestations = []types.Attestation{{
-		PublicKey: f.pk.PublicKey(),
+		PublicKey: f.randomActor().pk.PublicKey(),
 		Key:       "test",
 		Value:     []byte("1234"),
 	}}
-	signV2Transaction(f.n.tipState(), f.pk, &txn)
+	signV2Transaction(f.n.tipState(), f.keys, &txn)
 
 	for i := range txn.SiacoinOutputs {
 		sce := txn.EphemeralSiacoinOutput(i)